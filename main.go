@@ -2,15 +2,28 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
+	osexec "os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unicode"
+	"unicode/utf8"
 	"unsafe"
 )
 
@@ -21,6 +34,20 @@ type (
 		render        string
 		highlight     []int
 		hlOpenComment bool
+		// the delimiter of the multiline string left open at the end of the row
+		hlOpenString string
+
+		// the escape sequences last drawn for the row, see DrawRow
+		drawKey   drawKey
+		drawCache string
+		drawValid bool
+	}
+
+	drawKey struct {
+		render         string
+		offCol, width  int
+		showWhitespace bool
+		selFrom, selTo int
 	}
 
 	EditorSyntax struct {
@@ -30,27 +57,277 @@ type (
 		singleLineCommentStart string
 		multilineCommentStart  string
 		multilineCommentEnd    string
+		multilineStrings       []string // delimiters of strings that may span lines
 		flags                  int
 	}
 
+	// SyntaxDefinition is an EditorSyntax as written in the user syntax file
+	SyntaxDefinition struct {
+		FileType               string   `json:"fileType"`
+		FileMatch              []string `json:"fileMatch"`
+		Keywords               []string `json:"keywords"`
+		SingleLineCommentStart string   `json:"singleLineCommentStart"`
+		MultilineCommentStart  string   `json:"multilineCommentStart"`
+		MultilineCommentEnd    string   `json:"multilineCommentEnd"`
+		MultilineStrings       []string `json:"multilineStrings"`
+		Flags                  int      `json:"flags"`
+	}
+
+	// ThemeDefinition is a theme as written in the themes file,
+	// colors are like #rrggbb by highlight category
+	ThemeDefinition struct {
+		Name   string            `json:"name"`
+		Colors map[string]string `json:"colors"`
+	}
+
+	// EditorBuffer keeps the state of a file while another one is being edited
+	EditorBuffer struct {
+		filename               string
+		rows                   []EditorRow
+		x, y                   int
+		offRow, offCol         int
+		offWrap                int
+		syntax                 *EditorSyntax
+		dirty                  bool
+		narrowed               bool
+		narrowFrom             int
+		narrowHead, narrowTail []EditorRow
+		partial                bool
+		noHighlight            bool
+		highlighted            int
+		follow, following      bool
+		followOffset           int64
+		followPending          string
+		detectedIndent         *IndentProfile
+		undo, redo             []UndoStep
+		newline                string
+		noFinalNewline         bool
+		diskTime               time.Time
+		diskSize               int64
+	}
+
+	// IndentProfile is how a file type is indented
+	IndentProfile struct {
+		tabMode  string
+		tabWidth int
+	}
+
+	// EditorAction is a named command, bound to a key and listed in the command palette
+	EditorAction struct {
+		name string
+		key  rune
+		run  func(e *EditorConfig)
+	}
+
+	// EditorPane is the view of the pane not being edited when the screen is split
+	EditorPane struct {
+		x, y           int
+		offRow, offCol int
+		offWrap        int
+		screenRows     int
+	}
+
+	// UndoChange replaces the lines before with the lines after, from row at
+	UndoChange struct {
+		at            int
+		before, after []string
+	}
+
+	// UndoStep is the changes made by one key press, with the cursor before and after them
+	UndoStep struct {
+		changes []UndoChange
+		x, y    int
+		afterX  int
+		afterY  int
+	}
+
+	JumpPosition struct {
+		filename string
+		x, y     int
+	}
+
+	// Color is a text color as each color mode of terminals has it
+	Color struct {
+		basic   int // 30 to 37, or 90 to 97 for bright colors
+		index   int // in the 256-color palette
+		r, g, b int
+	}
+
+	// Theme is the colors of the highlight categories
+	Theme struct {
+		name   string
+		colors map[int]Color
+	}
+
+	// EditorConfig is an editor, main runs the one on screen
 	EditorConfig struct {
 		originTermios          *syscall.Termios
+		out                    io.Writer // where the screen is drawn
 		x, y                   int
 		renderX                int
 		screenRows, screenCols int
 		offRow, offCol         int
+		offWrap                int
 		rows                   []EditorRow
 		syntax                 *EditorSyntax
 		dirty                  bool
 		filename               string
 		statusMessage          string
+		statusMessageAt        time.Time
+		colorMode              string
+		cursorLine             bool
+		quitConfirm            int
+		quitTimes              int
+		theme                  *Theme
+		searchStatus           string
+		searchIgnoreCase       bool
+		searchRegexp           bool
+		narrowed               bool
+		narrowFrom             int
+		narrowHead, narrowTail []EditorRow
+		typewriter             bool
+		softWrap               bool
+		maxLoadLines           int
+		highlightMaxLines      int
+		highlightMaxBytes      int
+		partial                bool
+		noHighlight            bool
+		highlighted            int
+		follow, following      bool
+		followOffset           int64
+		followPending          string
+		jumps                  []JumpPosition
+		jumpIndex              int
+		showBranch             bool
+		gitBranch              string
+		gitBranchAt            time.Time
+		hexMode                bool
+		hexData                []byte
+		hexCursor              int
+		hexNibble              int
+		tabMode                string
+		tabWidth               int
+		defaultIndent          IndentProfile
+		detectIndent           bool
+		detectedIndent         *IndentProfile
+		lastQuery              string
+		lastDirection          int
+		lastKeyAt              time.Time
+		unsavedHintAfter       time.Duration
+		idleHint               string
+		autoSaveAfter          time.Duration
+		autoSaveSwap           bool
+		autoSavedAt            time.Time
+		prompting              bool
+		textWidth              int
+		drawCache              bool
+		once                   bool
+		mkdir                  bool
+		buffers                []EditorBuffer
+		buffer                 int
+		quitOnClose            bool
+		split                  bool
+		pane                   int
+		otherPane              EditorPane
+		overlay                []string
+		overlaySelected        int
+		centered               bool
+		centerWidth            int
+		lintIssues             []int
+		lineNumbers            bool
+		relativeNumbers        bool
+		clipboard              []string
+		clipboardMode          string
+		selecting              bool
+		blockSelect            bool
+		selX, selY             int // where the selection started, it ends at the cursor
+		showWhitespace         bool
+		backup                 bool
+		trimTrailing           bool
+		autoPair               bool
+		pairOpen               bool // the last key typed a pair, Backspace deletes both
+		recording, replaying   bool
+		macro, pendingKeys     []rune
+		macroStop              bool // the key replayed last failed, the rest of the macro is not
+		macroKeyStart          int  // length of the macro before the key press being processed
+		repeatCount            int  // typed with Alt and digits, for the next key
+		repeated               int  // times the key being repeated already ran
+		readOnly               bool
+		backedUp               map[string]bool
+		lintIndex              int
+		undo, redo             []UndoStep
+		undoLevels             int
+		undoOpen               bool
+		undoX, undoY           int
+		newline                string
+		noFinalNewline         bool
+		diskTime               time.Time
+		diskSize               int64
+
+		// a whole screen usually fits, so it gets to out in one write
+		writeBuf *bufio.Writer
+		// frame is the screen being drawn, screenLines the lines it had the last time
+		frame       bytes.Buffer
+		screenLines []string
+
+		// mouse is the last mouse report, x and y are 0-based screen cells
+		mouse struct {
+			button  int
+			x, y    int
+			pressed bool
+		}
+
+		// the files found so far by the crawl running in the background,
+		// a crawl of an earlier generation stops and its files are dropped
+		finder struct {
+			sync.Mutex
+			files      []string
+			generation int
+			active     bool
+			seen       int
+		}
+		finderQuery   string
+		finderMatches []string
+
+		paletteMatches []EditorAction
+
+		// filterHistory is the commands the buffer was filtered through, the last one last
+		filterHistory []string
+
+		lastMatch int
+		direction int
+		// searchFound tells whether the last search found the query
+		searchFound bool
+		// searchHistory is the queries searched for, the last one last
+		searchHistory []string
+		// where a search starts from and which way it goes when the query changes
+		searchOrigin    int
+		searchDirection int
+		// searchStart is the cursor and view before searching, for nothing to look for
+		searchStart EditorPane
+		// searchCompiled is the regexp compiled from the pattern searchCompiledFrom
+		searchCompiled     *regexp.Regexp
+		searchCompiledFrom string
+		searchCompileErr   error
+
+		// highlightSaved is the highlight of rows before matches were highlighted on them, by row
+		highlightSaved map[int][]int
+		// matchQuery is the query matchBefore was counted for,
+		// matchBefore[i] is the number of matches in the rows before row i
+		matchQuery  string
+		matchBefore []int
+		// bracketSaved is the highlight of the bracket matching the one at the cursor
+		// before HighlightBracket marked it
+		bracketSaved struct {
+			marked    bool
+			at, index int
+			highlight int
+		}
 	}
 )
 
-var (
-	E        = &EditorConfig{}
-	writeBuf = bufio.NewWriter(os.Stdin)
-)
+// resized receives SIGWINCH, it is handled between key presses by Idle
+var resized = make(chan os.Signal, 1)
 
 const (
 	HighlightNormal = iota
@@ -61,6 +338,10 @@ const (
 	HighlightMultilineComment
 	HighLightKeyword1
 	HighLightKeyword2
+	HighlightCurrentMatch
+	HighlightBracket
+	// the background of the cursor line in themes, text is never highlighted with it
+	HighlightCurrentLine
 )
 
 const (
@@ -101,7 +382,19 @@ var JavaHighlightKeywords = []string{
 	"float|", "true|", "false|", "long|", "char|", "int|", "short|", "byte|", "double|", "boolean|",
 }
 
-var HighlightDatabase = [...]EditorSyntax{
+var PythonSupportHighlightExtensions = []string{".py"}
+var PythonHighlightKeywords = []string{
+	"def", "class", "if", "elif", "else", "for", "while", "return", "import", "from",
+	"as", "with", "try", "except", "finally", "raise", "pass", "break", "continue",
+	"lambda", "yield", "global", "nonlocal", "in", "is", "not", "and", "or", "del",
+	"assert", "async", "await",
+
+	"int|", "str|", "float|", "bool|", "None|", "True|", "False|",
+	"list|", "dict|", "tuple|", "set|", "bytes|", "object|",
+}
+
+// HighlightDatabase is the built-in syntaxes, followed by the ones of the user syntax file
+var HighlightDatabase = []EditorSyntax{
 	{
 		fileType:               "c",
 		fileMatch:              CSupportHighlightExtensions,
@@ -117,6 +410,7 @@ var HighlightDatabase = [...]EditorSyntax{
 		singleLineCommentStart: "//",
 		multilineCommentStart:  "/*",
 		multilineCommentEnd:    "*/",
+		multilineStrings:       []string{"`"},
 		flags:                  FlagHighlightNumber | FlagHighlightString,
 		keywords:               GoHighlightKeywords,
 	},
@@ -126,9 +420,18 @@ var HighlightDatabase = [...]EditorSyntax{
 		singleLineCommentStart: "//",
 		multilineCommentStart:  "/*",
 		multilineCommentEnd:    "*/",
+		multilineStrings:       []string{`"""`},
 		flags:                  FlagHighlightNumber | FlagHighlightString,
 		keywords:               JavaHighlightKeywords,
 	},
+	{
+		fileType:               "python",
+		fileMatch:              PythonSupportHighlightExtensions,
+		singleLineCommentStart: "#",
+		multilineStrings:       []string{`"""`, "'''"},
+		flags:                  FlagHighlightNumber | FlagHighlightString,
+		keywords:               PythonHighlightKeywords,
+	},
 }
 
 const (
@@ -142,141 +445,838 @@ const (
 	CursorPosition       = Escape + "[6n"
 	CursorHide           = Escape + "[?25l"
 	CursorShow           = Escape + "[?25h"
+	AlternateScreenOn    = Escape + "[?1049h"
+	AlternateScreenOff   = Escape + "[?1049l"
+	MouseReportingOn     = Escape + "[?1000h" + Escape + "[?1006h"
+	MouseReportingOff    = Escape + "[?1006l" + Escape + "[?1000l"
 	ColorInverted        = Escape + "[7m"
 	ColorBack            = Escape + "[m"
 	TextColorDefault     = Escape + "[39m"
+	TextColorDim         = Escape + "[90m"
+	BackgroundDefault    = Escape + "[49m"
 	NewLine              = "\r\n"
 	Tilde                = "~"
 
-	TabStop = "    "
+	Ellipsis = "…"
 )
 
 const (
 	GimVersion = "0.0.1"
 	EmptyFile  = "[New File]"
+	StdinFile  = "[stdin]"
+
+	DefaultMaxLoadLines = 1000000
+	HighlightMaxLines   = 50000
+	HighlightMaxBytes   = 4 << 20
+	MaxJumps            = 100
+	MaxPromptHistory    = 100
+	StatusMessageTime   = 5 * time.Second
+	GitBranchRefresh    = 5 * time.Second
+	HexBytesPerRow      = 16
+	DefaultTextWidth    = 80
+	DefaultCenterWidth  = 80
+	DefaultUndoLevels   = 1000
+	DefaultQuitTimes    = 3
+)
+
+// what pressing Tab inserts
+const (
+	TabModeLiteral = "tab"    // a tab character
+	TabModeSpaces  = "spaces" // a full tab width of spaces
+	TabModeStop    = "stop"   // spaces up to the next tab stop
+)
+
+const (
+	ClipboardLines  = "lines"  // pasted as lines below the cursor
+	ClipboardInline = "inline" // pasted at the cursor
+	ClipboardBlock  = "block"  // pasted as a column from the cursor down
 )
 
+const DefaultTabWidth = 4
+
+// how many colors text is drawn with
+const (
+	ColorModeAuto  = "auto"      // by COLORTERM and TERM
+	ColorModeBasic = "8"         // the basic ANSI colors every terminal has
+	ColorMode256   = "256"       // the 256-color palette
+	ColorModeTrue  = "truecolor" // 24-bit RGB
+)
+
+// Formatters are the commands buffers are piped through before they are saved,
+// by EditorSyntax.fileType
+var Formatters = map[string]string{}
+
+// IndentProfiles are the indentation of file types, by EditorSyntax.fileType,
+// the -tabs and -tabwidth flags apply to the others
+var IndentProfiles = map[string]IndentProfile{
+	"go":     {tabMode: TabModeLiteral, tabWidth: 4},
+	"python": {tabMode: TabModeSpaces, tabWidth: 4},
+	"yaml":   {tabMode: TabModeSpaces, tabWidth: 2},
+}
+
 const (
-	Enter      = '\r'
-	Backspace  = 127
-	ArrowLeft  = iota + 1000 // <esc>[D
-	ArrowRight               // <esc>[C
-	ArrowUp                  // <esc>[A
-	ArrowDown                // <esc>[B
-	HomeKey                  // <esc>[1~ | <esc>[7~ | <esc>[H | <esc>OH
-	DelKey                   // <esc>[3~
-	EndKey                   // <esc>[4~ | <esc>[8~ | <esc>[F | <esc>OF
-	PageUp                   // <esc>[5~
-	PageDown                 // <esc>[6~
+	Enter          = '\r'
+	Backspace      = 127
+	ArrowLeft      = iota + 0x110000 // <esc>[D
+	ArrowRight                       // <esc>[C
+	ArrowUp                          // <esc>[A
+	ArrowDown                        // <esc>[B
+	HomeKey                          // <esc>[1~ | <esc>[7~ | <esc>[H | <esc>OH
+	DelKey                           // <esc>[3~
+	EndKey                           // <esc>[4~ | <esc>[8~ | <esc>[F | <esc>OF
+	PageUp                           // <esc>[5~
+	PageDown                         // <esc>[6~
+	AltArrowUp                       // <esc>[1;3A | <esc><esc>[A
+	AltArrowDown                     // <esc>[1;3B | <esc><esc>[B
+	MouseEvent                       // <esc>[<{button};{x};{y}M, details in mouse
+	CtrlArrowLeft                    // <esc>[1;5D
+	CtrlArrowRight                   // <esc>[1;5C
+	ShiftLeft                        // <esc>[1;2D
+	ShiftRight                       // <esc>[1;2C
+	ShiftUp                          // <esc>[1;2A
+	ShiftDown                        // <esc>[1;2B
+	ShiftHome                        // <esc>[1;2H
+	ShiftEnd                         // <esc>[1;2F
+	ShiftTab                         // <esc>[Z
+
+	AltModifier = 0x120000 // <esc>{key}
 )
 
 func main() {
-	EnableRawMode()
-	defer DisableRawMode()
+	e := NewEditor(os.Stdout)
+	flag.IntVar(&e.maxLoadLines, "max-lines", DefaultMaxLoadLines,
+		"load at most this many lines of a file, 0 for no limit")
+	flag.IntVar(&e.highlightMaxLines, "highlight-lines", HighlightMaxLines,
+		"don't highlight files with more lines than this, 0 for no limit")
+	flag.IntVar(&e.highlightMaxBytes, "highlight-bytes", HighlightMaxBytes,
+		"don't highlight files larger than this many bytes, 0 for no limit")
+	flag.BoolVar(&e.follow, "f", false, "follow the file as it grows, like tail -f")
+	flag.BoolVar(&e.readOnly, "R", false, "open files read-only")
+	flag.BoolVar(&e.showBranch, "branch", true, "show the git branch of the file in the status bar")
+	flag.BoolVar(&e.hexMode, "b", false, "edit the file as binary, byte by byte in hex")
+	flag.DurationVar(&e.unsavedHintAfter, "unsaved-hint", 0,
+		"pulse an unsaved indicator after being idle this long with unsaved changes, 0 to disable")
+	flag.DurationVar(&e.autoSaveAfter, "autosave", 0,
+		"save after being idle this long with unsaved changes, 0 to disable")
+	flag.BoolVar(&e.autoSaveSwap, "autosave-swap", false,
+		"auto-save to a .file.swp next to the file instead of the file itself")
+	flag.BoolVar(&e.once, "once", false,
+		"quit right after saving, and with exit code 1 when quitting unsaved, for use as $EDITOR")
+	flag.BoolVar(&e.quitOnClose, "quit-on-close", false,
+		"quit when the last buffer is closed, instead of starting a new file")
+	flag.BoolVar(&e.mkdir, "mkdir", false, "offer to create missing directories when saving")
+	flag.BoolVar(&e.backup, "backup", false, "copy a file to file~ before it is first overwritten")
+	flag.BoolVar(&e.trimTrailing, "trim", false, "strip trailing spaces and tabs from lines when saving")
+	flag.BoolVar(&e.drawCache, "draw-cache", true, "reuse the drawing of rows that did not change")
+	flag.BoolVar(&e.centered, "center", false, "show the text in a centered column")
+	flag.BoolVar(&e.lineNumbers, "numbers", false, "show line numbers")
+	flag.BoolVar(&e.showWhitespace, "whitespace", false, "show tabs and trailing spaces")
+	flag.BoolVar(&e.softWrap, "wrap", false, "wrap long lines instead of scrolling sideways")
+	flag.BoolVar(&e.autoPair, "pairs", false, "insert the closing bracket or quote along with the opening one")
+	flag.BoolVar(&e.cursorLine, "cursorline", false, "highlight the background of the cursor line")
+	flag.IntVar(&e.quitConfirm, "quit-times", DefaultQuitTimes,
+		"times Ctrl-q must be pressed again to quit with unsaved changes, 0 to quit at once")
+	flag.BoolVar(&e.relativeNumbers, "relative", false,
+		"show line numbers relative to the cursor line, with -numbers")
+	flag.IntVar(&e.centerWidth, "center-width", DefaultCenterWidth, "width of the centered column")
+	flag.IntVar(&e.textWidth, "textwidth", DefaultTextWidth, "width paragraphs are reflowed to")
+	flag.StringVar(&e.defaultIndent.tabMode, "tabs", TabModeLiteral,
+		"what Tab inserts: tab, spaces or stop (spaces to the next tab stop)")
+	flag.IntVar(&e.defaultIndent.tabWidth, "tabwidth", DefaultTabWidth, "number of columns of an indent and between tab stops")
+	flag.IntVar(&e.undoLevels, "undo-levels", DefaultUndoLevels, "number of changes that can be undone, 0 to disable undo")
+	flag.BoolVar(&e.detectIndent, "detect-indent", true, "detect the indentation of opened files")
+	indent := flag.String("indent", "",
+		"indentation per file type, like go=tab:4,python=spaces:4, overriding -tabs and -tabwidth")
+	format := flag.String("format", "",
+		"commands to format files with when saving, per file type, like go=gofmt,python=black -q -")
+	syntaxFile := flag.String("syntax", defaultSyntaxFile(), "file with more syntax definitions, as a JSON list")
+	flag.StringVar(&e.colorMode, "colors", ColorModeAuto, "colors to use: auto, 8, 256 or truecolor")
+	theme := flag.String("theme", DefaultTheme.name, "name of the color theme, like dark, light or one of the themes file")
+	themesFile := flag.String("themes", defaultThemesFile(), "file with more color themes, as a JSON list")
+	keysFile := flag.String("keys", defaultKeysFile(), "file binding keys to commands, as a JSON object")
+	flag.Parse()
+
+	syntaxErr := loadSyntaxFile(*syntaxFile)
+	if syntaxErr != nil {
+		log.Printf("warning: ignoring %s: %s", *syntaxFile, syntaxErr)
+	}
+	if err := loadThemesFile(*themesFile); err != nil {
+		log.Printf("warning: ignoring %s: %s", *themesFile, err)
+	}
+	actions = defaultActions()
+	keysErr := loadKeysFile(*keysFile)
+	if keysErr != nil {
+		log.Printf("warning: ignoring %s: %s", *keysFile, keysErr)
+	}
+
+	if !validTabMode(e.defaultIndent.tabMode) {
+		fmt.Fprintf(os.Stderr, "invalid -tabs %q, want tab, spaces or stop\n", e.defaultIndent.tabMode)
+		os.Exit(2)
+	}
+	if err := parseIndentProfiles(*indent); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -indent: %s\n", err)
+		os.Exit(2)
+	}
+	if err := parseFormatters(*format); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -format: %s\n", err)
+		os.Exit(2)
+	}
+	switch e.colorMode {
+	case ColorModeAuto:
+		e.colorMode = detectColorMode()
+	case ColorModeBasic, ColorMode256, ColorModeTrue:
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -colors %q, want auto, 8, 256 or truecolor\n", e.colorMode)
+		os.Exit(2)
+	}
+	if e.theme = findTheme(*theme); e.theme == nil {
+		fmt.Fprintf(os.Stderr, "unknown -theme %q\n", *theme)
+		os.Exit(2)
+	}
+
+	filename, line, col := parseFileArgs(flag.Args())
+	var piped []byte
+	if filename == "" && !isTerminal(os.Stdin) {
+		// like grep foo bar | gim, keys come from the terminal instead
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can't read stdin: %s\n", err)
+			os.Exit(1)
+		}
+		// a blocking fd keeps the VTIME read timeout Idle relies on
+		tty, err := syscall.Open("/dev/tty", syscall.O_RDWR, 0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can't open the terminal: %s\n", err)
+			os.Exit(1)
+		}
+		piped, os.Stdin = data, os.NewFile(uintptr(tty), "/dev/tty")
+	}
 
-	initEditor()
-	if len(os.Args) > 1 {
-		editorOpen(os.Args[1])
+	e.EnableRawMode()
+	defer e.DisableRawMode()
+	e.exec(AlternateScreenOn)
+	e.exec(MouseReportingOn)
+
+	e.Init()
+	if piped != nil {
+		e.Load(bytes.NewReader(piped), StdinFile)
+	} else if filename != "" && e.hexMode {
+		e.HexOpen(filename)
+	} else if isDirectory(filename) {
+		// rather than a listing of the directory to edit, pick a file in it
+		e.FindFileIn(filename)
+	} else if filename != "" {
+		e.maybe(e.Open(filename))
+		if e.follow {
+			e.StartFollow()
+		}
+		if line > 0 {
+			e.GotoLine(line, col)
+		}
 	}
 
-	StatusMessage("HELP: Ctrl-s = save | Ctrl-q = quit | Ctrl-F = find")
+	e.StatusMessage("HELP: Ctrl-s = save | Ctrl-q = quit | Ctrl-F = find | Ctrl-P = commands")
+	if e.once {
+		e.StatusMessage("HELP: Ctrl-s = save and quit | Ctrl-q = quit without saving")
+	}
+	if syntaxErr != nil {
+		e.StatusMessage("Ignoring %s: %s", *syntaxFile, syntaxErr)
+	}
+	if keysErr != nil {
+		e.StatusMessage("Ignoring %s: %s", *keysFile, keysErr)
+	}
+	if e.partial {
+		e.StatusMessage("Only the first %d lines are loaded (read-only), press Alt-l to load fully", len(e.rows))
+	} else if e.noHighlight {
+		e.StatusMessage("Highlighting is off for this large file, press Alt-h to turn it on")
+	}
 
 	for {
-		editorRefreshScreen()
-		editorProcessKeyPress()
+		e.RefreshScreen()
+		e.ProcessKeyPress()
+	}
+}
+
+// parseFileArgs finds the file to open and the line and column to start at,
+// given as "+line file" or "file:line[:column]" like compilers print them
+func parseFileArgs(args []string) (filename string, line, col int) {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "+") {
+			if n, err := strconv.Atoi(arg[1:]); err == nil {
+				line = n
+				continue
+			}
+		}
+		if filename == "" {
+			filename = arg
+		}
+	}
+
+	if _, err := os.Stat(filename); err == nil || filename == "" {
+		return
+	}
+
+	// peel off :column and :line while the name doesn't exist as given
+	parts := strings.Split(filename, ":")
+	var numbers []int
+	for len(parts) > 1 && len(numbers) < 2 {
+		n, err := strconv.Atoi(parts[len(parts)-1])
+		if err != nil {
+			break
+		}
+		numbers = append([]int{n}, numbers...)
+		parts = parts[:len(parts)-1]
+	}
+	if len(numbers) == 0 {
+		return
+	}
+
+	filename = strings.Join(parts, ":")
+	line = numbers[0]
+	if len(numbers) > 1 {
+		col = numbers[1]
 	}
+	return
 }
 
 /* init */
 
-func initEditor() {
-	E.screenRows, E.screenCols = GetWindowSize()
-	E.screenRows -= 2 // 1 for status bar, 1 for status message
-	E.filename = EmptyFile
+// NewEditor is an editor with an empty buffer and the default settings, drawing to out
+func NewEditor(out io.Writer) *EditorConfig {
+	e := &EditorConfig{
+		out:             out,
+		writeBuf:        bufio.NewWriterSize(out, 1<<16),
+		filename:        EmptyFile,
+		undoLevels:      DefaultUndoLevels,
+		defaultIndent:   IndentProfile{tabMode: TabModeLiteral, tabWidth: DefaultTabWidth},
+		theme:           &DefaultTheme,
+		colorMode:       ColorModeBasic,
+		lastMatch:       -1,
+		direction:       1,
+		searchOrigin:    -1,
+		searchDirection: 1,
+	}
+	e.ApplyIndentProfile()
+	return e
+}
+
+func (e *EditorConfig) Init() {
+	signal.Notify(resized, syscall.SIGWINCH)
+	e.UpdateWindowSize()
+	e.ApplyIndentProfile()
+	e.filename = EmptyFile
+	e.buffers = make([]EditorBuffer, 1)
+	e.quitTimes = e.quitConfirm
+}
+
+func (e *EditorConfig) UpdateWindowSize() {
+	e.screenRows, e.screenCols = e.GetWindowSize()
+	e.screenRows -= 2 // 1 for status bar, 1 for status message
+	// the terminal may have moved the lines around
+	e.screenLines = nil
+	if e.split {
+		e.LayoutPanes(e.screenRows)
+	}
 }
 
 /* file io */
 
-func editorOpen(filename string) {
+// Open loads filename into the buffer, a missing file is an empty buffer saved as it
+func (e *EditorConfig) Open(filename string) error {
 	file, err := os.Open(filename)
-	maybe(err)
+	if errors.Is(err, fs.ErrNotExist) {
+		e.Load(strings.NewReader(""), filename)
+		e.StatFile()
+		return nil
+	} else if err != nil {
+		return err
+	}
 	defer file.Close()
+	if info, err := file.Stat(); err == nil && info.IsDir() {
+		return fmt.Errorf("%s is a directory", filename)
+	}
+
+	e.Load(file, filename)
+	e.StatFile()
+	return nil
+}
+
+// Load reads the rows of the buffer named filename from r
+func (e *EditorConfig) Load(r io.Reader, filename string) {
+	e.partial = false
+	e.newline, e.noFinalNewline = "\n", false
+	rows := e.loadRows(nil, bufio.NewReader(r))
+
+	e.rows = rows
+	// the rows hidden by narrowing were of the text being replaced
+	e.narrowed, e.narrowFrom = false, 0
+	e.narrowHead, e.narrowTail = nil, nil
+	e.filename = filename
+	e.diskTime, e.diskSize = time.Time{}, 0
+	e.undo, e.redo = nil, nil
+	e.detectedIndent = nil
+	if e.detectIndent {
+		e.detectedIndent = detectIndent(rows)
+	}
+	e.RefreshGitBranch()
+	e.SelectSyntaxHighlight()
+	e.RenderRows()
+}
+
+// loadRows appends the lines read from reader to rows, up to the line limit,
+// where it stops with the buffer marked partial
+func (e *EditorConfig) loadRows(rows []EditorRow, reader *bufio.Reader) []EditorRow {
+	for {
+		line, err := reader.ReadString('\n')
+		if line == "" {
+			break
+		}
+		if e.maxLoadLines > 0 && len(rows) >= e.maxLoadLines {
+			e.partial = true
+			break
+		}
+
+		if strings.HasSuffix(line, "\n") {
+			line = line[:len(line)-1]
+			// the first line tells the line ending of the file
+			if len(rows) == 0 && strings.HasSuffix(line, "\r") {
+				e.newline = "\r\n"
+			}
+			if e.newline == "\r\n" {
+				line = strings.TrimSuffix(line, "\r")
+			}
+		} else {
+			e.noFinalNewline = true
+		}
+		rows = append(rows, EditorRow{idx: len(rows), line: line})
+		if err != nil {
+			break
+		}
+	}
+	return rows
+}
+
+// LoadFully reloads a partially loaded file without the line limit
+func (e *EditorConfig) LoadFully() {
+	if !e.partial {
+		e.StatusMessage("File is already fully loaded")
+		return
+	}
+
+	e.Widen()
+	maxLoadLines := e.maxLoadLines
+	e.maxLoadLines = 0
+	err := e.Open(e.filename)
+	e.maxLoadLines = maxLoadLines
+	if err != nil {
+		e.StatusMessage("Can't load %s", err)
+		return
+	}
+	if e.following {
+		// the lines written since are loaded already
+		e.StartFollow()
+	}
+	e.StatusMessage("Loaded %d lines", len(e.rows))
+}
 
-	var rows []EditorRow
-	reader := bufio.NewReader(file)
+// Reload discards the changes to the buffer and reads the file again,
+// the cursor stays where it was as far as the file still goes
+func (e *EditorConfig) Reload() {
+	if e.Unnamed() {
+		e.StatusMessage("No file to reload")
+		return
+	}
+	if e.dirty {
+		answer, ok := e.Prompt("Buffer has unsaved changes, discard them? (y/n) %s", nil)
+		if !ok || answer != "y" {
+			e.StatusMessage("Reload aborted")
+			return
+		}
+	}
 
-	for line, isPrefix, err := reader.ReadLine(); isPrefix || err == nil; {
-		rows = append(rows, EditorRow{line: string(line)})
-		line, isPrefix, err = reader.ReadLine()
+	if e.hexMode {
+		data, err := os.ReadFile(e.filename)
+		if err != nil {
+			e.StatusMessage("Can't reload! %s", err)
+			return
+		}
+		e.hexData = data
+		if e.hexCursor >= len(data) && len(data) > 0 {
+			e.hexCursor = len(data) - 1
+		}
+		e.hexNibble = 0
+		e.StatFile()
+	} else {
+		e.Widen()
+		x, y := e.x, e.y
+		if err := e.Open(e.filename); err != nil {
+			e.StatusMessage("Can't reload! %s", err)
+			return
+		}
+		e.x, e.y = x, y
+		e.ClampCursor()
 	}
 
-	E.rows = rows
-	E.filename = filename
-	editorSelectSyntaxHighlight()
-	editorRenderRows()
+	e.dirty = false
+	e.RemoveSwapFile(e.filename)
+	e.StatusMessage("Reloaded %s", e.filename)
+}
+
+// Unnamed reports whether the buffer has no file to be saved to
+func (e *EditorConfig) Unnamed() bool {
+	return e.filename == EmptyFile || e.filename == StdinFile
+}
+
+// CheckWritable reports whether the buffer may be modified,
+// telling the user why not otherwise
+func (e *EditorConfig) CheckWritable() bool {
+	if e.readOnly {
+		e.StatusMessage("File is read-only, press Alt-L to allow editing")
+		return false
+	}
+	if e.partial {
+		e.StatusMessage("Read-only: file is partially loaded, press Alt-l to load it fully")
+		return false
+	}
+	if e.follow {
+		e.StatusMessage("Read-only: file is opened in follow mode")
+		return false
+	}
+	return true
 }
 
-func editorSave() {
-	if E.filename == EmptyFile {
-		filename, ok := editorPrompt("Save as: %s", nil)
+func (e *EditorConfig) Save() {
+	if !e.CheckWritable() {
+		return
+	}
+	if e.Unnamed() {
+		filename, ok := e.Prompt("Save as: %s", nil)
 		if !ok {
-			StatusMessage("Save aborted")
+			e.StatusMessage("Save aborted")
+			return
+		}
+		if !e.EnsureDir(filename) {
+			return
+		}
+		e.filename = filename
+		e.SelectSyntaxHighlight()
+	} else if !e.EnsureDir(e.filename) {
+		return
+	} else if e.ChangedOnDisk() {
+		answer, ok := e.Prompt("File changed on disk. Overwrite? (y/n) %s", nil)
+		if !ok || answer != "y" {
+			e.StatusMessage("Save aborted")
 			return
 		}
-		E.filename = filename
-		editorSelectSyntaxHighlight()
 	}
 
-	file, err := os.OpenFile(E.filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	maybe(err)
-	defer file.Close()
+	var warning string
+	if !e.hexMode {
+		warning = e.Format()
+	}
+	if e.trimTrailing && !e.hexMode {
+		e.TrimTrailing()
+	}
+	if err := e.Backup(e.filename); err != nil {
+		e.StatusMessage("Can't back up! %s", err)
+		return
+	}
+	size, err := e.WriteFile(e.filename)
+	if err != nil {
+		e.StatusMessage("Can't save! %s", err)
+		return
+	}
+
+	if warning != "" {
+		e.StatusMessage("%d bytes written to disk, %s", size, warning)
+	} else {
+		e.StatusMessage("%d bytes written to disk", size)
+	}
+	e.StatFile()
+	e.RemoveSwapFile(e.filename)
+	e.RefreshGitBranch()
+
+	e.dirty = false
+}
+
+// Format pipes the buffer through the formatter of its file type,
+// it returns why the buffer was left as it is when the formatter fails
+func (e *EditorConfig) Format() string {
+	if e.syntax == nil {
+		return ""
+	}
+	command, ok := Formatters[e.syntax.fileType]
+	if !ok {
+		return ""
+	}
+	if e.narrowed {
+		// the formatter would only see a part of the file
+		return "not formatted while narrowed"
+	}
+
+	lines, err := e.RunFilter(command)
+	if err != nil {
+		return fmt.Sprintf("not formatted: %s", err)
+	}
+	changed := len(lines) != len(e.rows)
+	for i := 0; !changed && i < len(lines); i++ {
+		changed = lines[i] != e.rows[i].line
+	}
+	if !changed {
+		return ""
+	}
+
+	// follow the text the cursor was on, wherever its line went
+	var text string
+	var col int
+	if row, ok := e.GetCurRow(); ok {
+		text = strings.TrimLeft(row.line, " \t")
+		col = e.x - (len(row.line) - len(text))
+	}
+	e.ReplaceRows(0, len(e.rows), lines)
+	if text != "" {
+		if at := nearestLine(lines, e.y, text); at != -1 {
+			e.y = at
+			e.x = len(lines[at]) - len(text) + col
+			if col < 0 {
+				e.x = len(lines[at]) - len(text)
+			}
+		}
+	}
+	e.ClampCursor()
+	return ""
+}
+
+// nearestLine is the line closest to at that is text after its indentation, or -1
+func nearestLine(lines []string, at int, text string) int {
+	for distance := 0; distance < len(lines); distance++ {
+		for _, i := range []int{at - distance, at + distance} {
+			if i >= 0 && i < len(lines) && strings.TrimLeft(lines[i], " \t") == text {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// TrimTrailing strips the spaces and tabs at the end of the rows,
+// the rows hidden by narrowing are kept as they are
+func (e *EditorConfig) TrimTrailing() {
+	for i := range e.rows {
+		e.SetLine(i, strings.TrimRight(e.rows[i].line, " \t"))
+	}
+
+	// the cursor may have been in the stripped whitespace
+	if row, ok := e.GetCurRow(); ok && e.x > len(row.line) {
+		e.x = len(row.line)
+	}
+}
+
+// StatFile remembers the modification time and size of the file,
+// to tell whether someone else changed it when saving
+func (e *EditorConfig) StatFile() {
+	e.diskTime, e.diskSize = time.Time{}, 0
+	if info, err := os.Stat(e.filename); err == nil {
+		e.diskTime, e.diskSize = info.ModTime(), info.Size()
+	}
+}
+
+// ChangedOnDisk reports whether the file was modified since it was opened or saved
+func (e *EditorConfig) ChangedOnDisk() bool {
+	if e.diskTime.IsZero() {
+		return false
+	}
+	info, err := os.Stat(e.filename)
+	if err != nil {
+		// gone or unreadable, writing it tells what is wrong
+		return false
+	}
+	return !info.ModTime().Equal(e.diskTime) || info.Size() != e.diskSize
+}
+
+// Backup copies filename to filename~ the first time it is saved,
+// keeping its permissions and modification time
+func (e *EditorConfig) Backup(filename string) error {
+	if !e.backup || e.backedUp[filename] {
+		return nil
+	}
+	info, err := os.Stat(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		// nothing to lose
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	backup := filename + "~"
+	if err := os.WriteFile(backup, data, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Chtimes(backup, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+
+	if e.backedUp == nil {
+		e.backedUp = make(map[string]bool)
+	}
+	e.backedUp[filename] = true
+	return nil
+}
+
+// WriteFile writes the buffer to a temporary file next to filename, then renames it
+// over filename, so that filename is left untouched when anything goes wrong
+func (e *EditorConfig) WriteFile(filename string) (size int, err error) {
+	// write where a link points, instead of replacing the link
+	if target, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = target
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
 
-	var size int
 	writer := bufio.NewWriter(file)
-	for _, row := range E.rows {
+	if e.hexMode {
+		// bytes are written back verbatim
+		size = len(e.hexData)
+		writer.Write(e.hexData)
+	}
+	newline := e.newline
+	if newline == "" {
+		newline = "\n"
+	}
+	rows := e.AllRows()
+	for i, row := range rows {
 		size += len(row.line)
 		writer.WriteString(row.line)
-		writer.WriteString(NewLine)
+		// keep a file without a newline at its end that way
+		if i < len(rows)-1 || !e.noFinalNewline {
+			size += len(newline)
+			writer.WriteString(newline)
+		}
+	}
+
+	if err = writer.Flush(); err != nil {
+		return 0, err
+	}
+	if err = file.Chmod(mode); err != nil {
+		return 0, err
+	}
+	if err = file.Sync(); err != nil {
+		return 0, err
+	}
+	if err = file.Close(); err != nil {
+		return 0, err
+	}
+	return size, os.Rename(file.Name(), filename)
+}
+
+// EnsureDir checks the directory to save filename in exists,
+// creating it if the user allows and -mkdir is set
+func (e *EditorConfig) EnsureDir(filename string) bool {
+	dir := filepath.Dir(filename)
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return true
+	}
+
+	if !e.mkdir {
+		e.StatusMessage("Can't save! Directory %s does not exist", dir)
+		return false
 	}
-	writer.Flush()
 
-	StatusMessage("%d bytes written to disk", size)
+	answer, ok := e.Prompt("Directory "+strings.ReplaceAll(dir, "%", "%%")+" does not exist, create it? (y/n) %s", nil)
+	if !ok || !strings.EqualFold(answer, "y") {
+		e.StatusMessage("Save aborted")
+		return false
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		e.StatusMessage("Can't create %s: %s", dir, err)
+		return false
+	}
+	return true
+}
 
-	E.dirty = false
+func (e *EditorConfig) RenderRows() {
+	for i := 0; i < len(e.rows); i++ {
+		e.RenderRow(&e.rows[i])
+	}
 }
 
-func editorRenderRows() {
-	for i := 0; i < len(E.rows); i++ {
-		editorRenderRow(&E.rows[i])
+func (e *EditorConfig) RenderRow(row *EditorRow) {
+	if !strings.Contains(row.line, "\t") {
+		row.render = row.line
+		e.RenderSyntax(row)
+		return
+	}
+
+	// tabs are expanded up to the next tab stop
+	var builder strings.Builder
+	var col int
+	for _, char := range row.line {
+		if char == '\t' {
+			spaces := e.tabWidth - col%e.tabWidth
+			builder.WriteString(strings.Repeat(" ", spaces))
+			col += spaces
+		} else {
+			builder.WriteRune(char)
+			col += runeWidth(char)
+		}
 	}
+	row.render = builder.String()
+	e.RenderSyntax(row)
 }
 
-func editorRenderRow(row *EditorRow) {
-	line := row.line
-	line = strings.ReplaceAll(line, "\t", TabStop)
-	row.render = line
-	editorRenderSyntax(row)
+// HighlightTo highlights the rows up to last that are not yet, one after
+// the other as comments and strings left open carry over to the next row
+func (e *EditorConfig) HighlightTo(last int) {
+	if e.syntax == nil || e.noHighlight {
+		return
+	}
+	for e.highlighted <= last && e.highlighted < len(e.rows) {
+		e.highlighted++
+		e.RenderSyntax(&e.rows[e.highlighted-1])
+	}
 }
 
-func editorRenderSyntax(row *EditorRow) {
+func (e *EditorConfig) RenderSyntax(row *EditorRow) {
+	row.drawValid = false
 	row.highlight = make([]int, len(row.render))
 	for i := 0; i < len(row.highlight); i++ {
 		row.highlight[i] = HighlightNormal
 	}
 
-	if E.syntax == nil {
+	if e.syntax == nil || e.noHighlight {
+		return
+	}
+	if row.idx >= e.highlighted {
+		// after the rows before it are, by HighlightTo
 		return
 	}
 
-	comment := E.syntax.singleLineCommentStart
-	keywords := E.syntax.keywords
-	mcs := E.syntax.multilineCommentStart
-	mce := E.syntax.multilineCommentEnd
+	comment := e.syntax.singleLineCommentStart
+	keywords := e.syntax.keywords
+	mcs := e.syntax.multilineCommentStart
+	mce := e.syntax.multilineCommentEnd
 
 	prevSeparator := true
 	prevHighlight := HighlightNormal
 	var inString rune
-	inComment := row.idx > 0 && E.rows[row.idx-1].hlOpenComment
+	inComment, openString := e.openBefore(row.idx)
 
 	var i int
 	var char rune
@@ -289,6 +1289,32 @@ func editorRenderSyntax(row *EditorRow) {
 			prevHighlight = HighlightNormal
 		}
 
+		if openString != "" {
+			// everything up to the closing delimiter is in the string
+			if strings.HasPrefix(row.render[i:], openString) {
+				for j := i; j < i+len(openString); j++ {
+					row.highlight[j] = HighlightString
+				}
+				i += len(openString)
+				openString = ""
+				prevSeparator = true
+			} else {
+				row.highlight[i] = HighlightString
+				i++
+			}
+			continue
+		}
+		if e.syntax.flags&FlagHighlightString != 0 && inString == 0 && !inComment {
+			if delimiter := e.multilineStringStart(row.render[i:]); delimiter != "" {
+				for j := i; j < i+len(delimiter); j++ {
+					row.highlight[j] = HighlightString
+				}
+				i += len(delimiter)
+				openString = delimiter
+				continue
+			}
+		}
+
 		if comment != "" && inString == 0 && !inComment {
 			if strings.HasPrefix(row.render[i:], comment) {
 				for ; i < len(row.render); i++ {
@@ -325,7 +1351,7 @@ func editorRenderSyntax(row *EditorRow) {
 			}
 		}
 
-		if E.syntax.flags&FlagHighlightString == 2 {
+		if e.syntax.flags&FlagHighlightString != 0 {
 			if inString != 0 {
 				row.highlight[i] = HighlightString
 
@@ -351,7 +1377,7 @@ func editorRenderSyntax(row *EditorRow) {
 			}
 		}
 
-		if E.syntax.flags&FlagHighlightNumber == 1 {
+		if e.syntax.flags&FlagHighlightNumber != 0 {
 			if (unicode.IsDigit(char) &&
 				(prevSeparator || prevHighlight == HighlightNumber)) ||
 				char == '.' && prevHighlight == HighlightNumber {
@@ -404,57 +1430,323 @@ func editorRenderSyntax(row *EditorRow) {
 		i++
 	}
 
-	changed := row.hlOpenComment != inComment
+	changed := row.hlOpenComment != inComment || row.hlOpenString != openString
 	row.hlOpenComment = inComment
-	if changed && row.idx+1 < len(E.rows) {
-		editorRenderSyntax(&E.rows[row.idx+1])
+	row.hlOpenString = openString
+	if changed && row.idx+1 < e.highlighted {
+		e.RenderSyntax(&e.rows[row.idx+1])
 	}
 }
 
+// openBefore is the comment and string left open at the end of the row before row at,
+// for the first row when narrowed the last one of the rows hidden before it
+func (e *EditorConfig) openBefore(at int) (comment bool, str string) {
+	if at > 0 {
+		return e.rows[at-1].hlOpenComment, e.rows[at-1].hlOpenString
+	}
+	if e.narrowed && len(e.narrowHead) > 0 {
+		last := e.narrowHead[len(e.narrowHead)-1]
+		return last.hlOpenComment, last.hlOpenString
+	}
+	return false, ""
+}
+
+// multilineStringStart is the multiline string delimiter text starts with, if any
+func (e *EditorConfig) multilineStringStart(text string) string {
+	for _, delimiter := range e.syntax.multilineStrings {
+		if strings.HasPrefix(text, delimiter) {
+			return delimiter
+		}
+	}
+	return ""
+}
+
 func isSeparator(char rune) bool {
-	return unicode.IsSpace(char) || strings.ContainsRune(",.()+-/*=~%<>{};", char)
-}
-
-func editorSyntaxToColor(hl int) int {
-	switch hl {
-	case HighlightNumber:
-		return 31 // red
-	case HighlightMatch:
-		return 34 // blue
-	case HighlightString:
-		return 35 // magenta
-	case HighlightComment, HighlightMultilineComment:
-		return 36 // cyan
-	case HighLightKeyword1:
-		return 33 // yellow
-	case HighLightKeyword2:
-		return 32 // green
+	// highlighting goes byte by byte, the bytes of other characters are never separators
+	if char >= utf8.RuneSelf {
+		return false
+	}
+	return unicode.IsSpace(char) || strings.ContainsRune(",.()+-/*=~%<>{}[];:", char)
+}
+
+// DefaultTheme keeps the basic colors of the highlight categories,
+// with softer ones where the terminal has more
+var DefaultTheme = Theme{
+	name: "default",
+	colors: map[int]Color{
+		HighlightNumber:           {basic: 31, index: 209, r: 0xde, g: 0x93, b: 0x5f}, // red
+		HighlightMatch:            {basic: 34, index: 75, r: 0x5f, g: 0xaf, b: 0xff},  // blue
+		HighlightCurrentMatch:     {basic: 34, index: 75, r: 0x5f, g: 0xaf, b: 0xff},
+		HighlightString:           {basic: 35, index: 176, r: 0xb2, g: 0x94, b: 0xbb}, // magenta
+		HighlightComment:          {basic: 36, index: 109, r: 0x8a, g: 0xbe, b: 0xb7}, // cyan
+		HighlightMultilineComment: {basic: 36, index: 109, r: 0x8a, g: 0xbe, b: 0xb7},
+		HighLightKeyword1:         {basic: 33, index: 221, r: 0xf0, g: 0xc6, b: 0x74}, // yellow
+		HighLightKeyword2:         {basic: 32, index: 150, r: 0xb5, g: 0xbd, b: 0x68}, // green
+		HighlightBracket:          {basic: 91, index: 203, r: 0xff, g: 0x5f, b: 0x5f}, // bright red
+		HighlightCurrentLine:      {basic: 90, index: 236, r: 0x30, g: 0x30, b: 0x30}, // gray
+	},
+}
+
+// Themes are the themes -theme chooses from, the themes file adds to them
+var Themes = []*Theme{
+	&DefaultTheme,
+	rgbTheme("dark", map[int]string{
+		HighlightNumber:   "#f78c6c",
+		HighlightMatch:    "#82aaff",
+		HighlightString:   "#c3e88d",
+		HighlightComment:  "#697098",
+		HighLightKeyword1: "#c792ea",
+		HighLightKeyword2: "#ffcb6b",
+		HighlightBracket:  "#ff5370",
+		// a little lighter than the usual dark background
+		HighlightCurrentLine: "#2f3447",
+	}),
+	rgbTheme("light", map[int]string{
+		HighlightNumber:   "#986801",
+		HighlightMatch:    "#4078f2",
+		HighlightString:   "#50a14f",
+		HighlightComment:  "#a0a1a7",
+		HighLightKeyword1: "#a626a4",
+		HighLightKeyword2: "#c18401",
+		HighlightBracket:  "#e45649",
+		// a little darker than the usual light background
+		HighlightCurrentLine: "#ecedf0",
+	}),
+}
+
+// ThemeCategories are the highlight categories by their name in the themes file
+var ThemeCategories = map[string]int{
+	"number":   HighlightNumber,
+	"string":   HighlightString,
+	"comment":  HighlightComment,
+	"keyword1": HighLightKeyword1,
+	"keyword2": HighLightKeyword2,
+	"match":    HighlightMatch,
+	"bracket":  HighlightBracket,
+	// a background color
+	"currentLine": HighlightCurrentLine,
+}
+
+// rgbTheme makes the theme name of colors like #rrggbb,
+// multiline comments and the current match are colored like comments and matches
+func rgbTheme(name string, colors map[int]string) *Theme {
+	theme := &Theme{name: name, colors: make(map[int]Color)}
+	for hl, hex := range colors {
+		color, err := parseColor(hex)
+		if err != nil {
+			panic(err)
+		}
+		theme.colors[hl] = color
+	}
+	if color, ok := theme.colors[HighlightComment]; ok {
+		theme.colors[HighlightMultilineComment] = color
+	}
+	if color, ok := theme.colors[HighlightMatch]; ok {
+		theme.colors[HighlightCurrentMatch] = color
+	}
+	return theme
+}
+
+// findTheme returns the theme called name, or nil
+func findTheme(name string) *Theme {
+	for _, theme := range Themes {
+		if theme.name == name {
+			return theme
+		}
+	}
+	return nil
+}
+
+func defaultThemesFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".gim", "themes.json")
+}
+
+// loadThemesFile adds the themes defined in filename to Themes, replacing the ones
+// of the same name, a missing file is not an error, a malformed one adds none of them
+func loadThemesFile(filename string) error {
+	if filename == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var definitions []ThemeDefinition
+	if err := json.Unmarshal(data, &definitions); err != nil {
+		return err
+	}
+
+	themes := make([]*Theme, 0, len(definitions))
+	for i, d := range definitions {
+		if d.Name == "" {
+			return fmt.Errorf("theme %d needs a name", i+1)
+		}
+		colors := make(map[int]string)
+		for category, color := range d.Colors {
+			hl, ok := ThemeCategories[category]
+			if !ok {
+				return fmt.Errorf("theme %s has an unknown category %q", d.Name, category)
+			}
+			if _, err := parseColor(color); err != nil {
+				return fmt.Errorf("theme %s: %s", d.Name, err)
+			}
+			colors[hl] = color
+		}
+		themes = append(themes, rgbTheme(d.Name, colors))
+	}
+
+	for _, theme := range themes {
+		if earlier := findTheme(theme.name); earlier != nil {
+			*earlier = *theme
+		} else {
+			Themes = append(Themes, theme)
+		}
+	}
+	return nil
+}
+
+// parseColor reads a color like #rrggbb, approximating it in the palettes of fewer colors
+func parseColor(hex string) (Color, error) {
+	var r, g, b int
+	if n, err := fmt.Sscanf(hex, "#%02x%02x%02x", &r, &g, &b); n != 3 || err != nil || len(hex) != 7 {
+		return Color{}, fmt.Errorf("invalid color %q, want #rrggbb", hex)
+	}
+	return Color{basic: nearestBasicColor(r, g, b), index: nearestPaletteColor(r, g, b), r: r, g: g, b: b}, nil
+}
+
+// basicColors are the usual RGB values of the basic colors, by their escape code
+var basicColors = map[int][3]int{
+	30: {0, 0, 0}, 31: {205, 0, 0}, 32: {0, 205, 0}, 33: {205, 205, 0},
+	34: {0, 0, 238}, 35: {205, 0, 205}, 36: {0, 205, 205}, 37: {229, 229, 229},
+	90: {127, 127, 127}, 91: {255, 0, 0}, 92: {0, 255, 0}, 93: {255, 255, 0},
+	94: {92, 92, 255}, 95: {255, 0, 255}, 96: {0, 255, 255}, 97: {255, 255, 255},
+}
+
+func nearestBasicColor(r, g, b int) int {
+	nearest, distance := 37, -1
+	for code, rgb := range basicColors {
+		d := colorDistance(r, g, b, rgb[0], rgb[1], rgb[2])
+		if distance == -1 || d < distance || d == distance && code < nearest {
+			nearest, distance = code, d
+		}
+	}
+	return nearest
+}
+
+// nearestPaletteColor is the index of the color of the 6x6x6 cube or of the gray ramp
+// of the 256-color palette closest to r, g, b
+func nearestPaletteColor(r, g, b int) int {
+	levels := []int{0, 95, 135, 175, 215, 255}
+	level := func(c int) int {
+		nearest := 0
+		for i, l := range levels {
+			if abs(c-l) < abs(c-levels[nearest]) {
+				nearest = i
+			}
+		}
+		return nearest
+	}
+	cr, cg, cb := level(r), level(g), level(b)
+	cube := 16 + 36*cr + 6*cg + cb
+	cubeDistance := colorDistance(r, g, b, levels[cr], levels[cg], levels[cb])
+
+	// grays go from 8 to 238 by 10
+	gray := ((r+g+b)/3 - 8 + 5) / 10
+	if gray < 0 {
+		gray = 0
+	} else if gray > 23 {
+		gray = 23
+	}
+	value := 8 + gray*10
+	if colorDistance(r, g, b, value, value, value) < cubeDistance {
+		return 232 + gray
+	}
+	return cube
+}
+
+func colorDistance(r1, g1, b1, r2, g2, b2 int) int {
+	return (r1-r2)*(r1-r2) + (g1-g2)*(g1-g2) + (b1-b2)*(b1-b2)
+}
+
+// detectColorMode tells the colors the terminal has from COLORTERM, then TERM
+func detectColorMode() string {
+	switch os.Getenv("COLORTERM") {
+	case "truecolor", "24bit":
+		return ColorModeTrue
+	}
+	if strings.Contains(os.Getenv("TERM"), "256color") {
+		return ColorMode256
+	}
+	return ColorModeBasic
+}
+
+// colorEscape is the escape sequence drawing text in color with mode
+func colorEscape(color Color, mode string) string {
+	switch mode {
+	case ColorModeTrue:
+		return fmt.Sprintf("%s[38;2;%d;%d;%dm", Escape, color.r, color.g, color.b)
+	case ColorMode256:
+		return fmt.Sprintf("%s[38;5;%dm", Escape, color.index)
 	default:
-		return 37
+		return fmt.Sprintf("%s[%dm", Escape, color.basic)
 	}
 }
 
-func editorSelectSyntaxHighlight() {
-	E.syntax = nil
-	if E.filename == EmptyFile {
-		return
+// backgroundEscape is the escape sequence drawing the background in color with mode
+func backgroundEscape(color Color, mode string) string {
+	switch mode {
+	case ColorModeTrue:
+		return fmt.Sprintf("%s[48;2;%d;%d;%dm", Escape, color.r, color.g, color.b)
+	case ColorMode256:
+		return fmt.Sprintf("%s[48;5;%dm", Escape, color.index)
+	default:
+		// the background codes are the foreground ones plus 10
+		return fmt.Sprintf("%s[%dm", Escape, color.basic+10)
+	}
+}
+
+// SyntaxToColor is the escape sequence of the color of the highlight category hl,
+// the default color when the theme has none for it
+func (e *EditorConfig) SyntaxToColor(hl int) string {
+	color, ok := e.theme.colors[hl]
+	if !ok {
+		return TextColorDefault
 	}
+	return colorEscape(color, e.colorMode)
+}
 
-	dotIdx := strings.LastIndex(E.filename, ".")
-	var ext string
-	if dotIdx != -1 {
-		ext = E.filename[dotIdx:]
-	} else {
-		ext = ""
+func (e *EditorConfig) SelectSyntaxHighlight() {
+	defer e.ApplyIndentProfile()
+
+	e.syntax = nil
+	e.highlighted = 0
+	if e.Unnamed() {
+		return
 	}
 
-	for _, syntax := range HighlightDatabase {
+	base := filepath.Base(e.filename)
+	ext := filepath.Ext(base)
+
+	for i := range HighlightDatabase {
+		syntax := &HighlightDatabase[i]
 		for _, match := range syntax.fileMatch {
-			if strings.Contains(match, ext) {
-				E.syntax = &syntax
+			if syntaxMatches(match, base, ext) {
+				e.syntax = syntax
+				if e.noHighlight = e.TooLargeToHighlight(); e.noHighlight {
+					e.StatusMessage("Highlighting is off for this large file, press Alt-h to turn it on")
+					return
+				}
 
-				for i := 0; i < len(E.rows); i++ {
-					editorRenderSyntax(&E.rows[i])
+				// the rows are highlighted as they come into view
+				for i := 0; i < len(e.rows); i++ {
+					e.RenderSyntax(&e.rows[i])
 				}
 
 				return
@@ -463,552 +1755,4647 @@ func editorSelectSyntaxHighlight() {
 	}
 }
 
-/* find */
-func editorFind() {
-	lastX, lastY := E.x, E.y
-	lastOffCol, lastOffRow := E.offCol, E.offRow
-	editorPrompt("Search: %s (Use ESC/Arrows/Enter)", editorFindCallBack)
+// TooLargeToHighlight reports whether the buffer is over the
+// -highlight-lines or -highlight-bytes limit
+func (e *EditorConfig) TooLargeToHighlight() bool {
+	if e.highlightMaxLines > 0 && len(e.rows) > e.highlightMaxLines {
+		return true
+	}
+	if e.highlightMaxBytes <= 0 {
+		return false
+	}
+	var size int
+	for _, row := range e.rows {
+		if size += len(row.line) + 1; size > e.highlightMaxBytes {
+			return true
+		}
+	}
+	return false
+}
 
-	E.x, E.y = lastX, lastY
-	E.offCol, E.offRow = lastOffCol, lastOffRow
+// ToggleHighlight turns syntax highlighting off, or on even for a large file
+func (e *EditorConfig) ToggleHighlight() {
+	if e.syntax == nil {
+		e.StatusMessage("No syntax highlighting for this file type")
+		return
+	}
+	e.noHighlight = !e.noHighlight
+	e.highlighted = 0
+	for i := range e.rows {
+		e.RenderSyntax(&e.rows[i])
+	}
+	if e.noHighlight {
+		e.StatusMessage("Highlighting off")
+	} else {
+		e.StatusMessage("Highlighting on")
+	}
 }
 
-var lastMatch = -1
-var direction = 1
-var highlightRowIndex = -1
-var highlightRowContent []int
+// syntaxMatches reports whether a fileMatch entry matches a file,
+// entries starting with a dot are extensions, the others basename patterns like Makefile
+func syntaxMatches(match, base, ext string) bool {
+	if strings.HasPrefix(match, ".") {
+		return match == ext
+	}
+	matched, err := filepath.Match(match, base)
+	return err == nil && matched
+}
 
-func editorFindCallBack(query string, key rune) {
+/* syntax file */
 
-	if highlightRowIndex != -1 {
-		E.rows[highlightRowIndex].highlight = highlightRowContent
-		highlightRowIndex = -1
+func defaultSyntaxFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
 	}
+	return filepath.Join(home, ".gim", "syntax.json")
+}
 
-	if key == EndKey || key == EscapeChar {
-		lastMatch = -1
-		direction = 1
-		return
-	} else if key == ArrowRight || key == ArrowDown {
-		direction = 1
-	} else if key == ArrowLeft || key == ArrowUp {
-		direction = -1
-	} else {
-		lastMatch = -1
-		direction = 1
+// loadSyntaxFile adds the syntaxes defined in filename to HighlightDatabase,
+// a missing file is not an error, a malformed one adds none of them
+func loadSyntaxFile(filename string) error {
+	if filename == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
 	}
 
-	if lastMatch == -1 {
-		direction = 1
+	var definitions []SyntaxDefinition
+	if err := json.Unmarshal(data, &definitions); err != nil {
+		return err
 	}
-	current := lastMatch
 
-	for range E.rows {
-		current += direction
-		if current == -1 {
-			current = len(E.rows) - 1
-		} else if current == len(E.rows) {
-			current = 0
+	syntaxes := make([]EditorSyntax, 0, len(definitions))
+	for i, d := range definitions {
+		if d.FileType == "" || len(d.FileMatch) == 0 {
+			return fmt.Errorf("syntax %d needs a fileType and a fileMatch", i+1)
+		}
+		if (d.MultilineCommentStart == "") != (d.MultilineCommentEnd == "") {
+			return fmt.Errorf("syntax %s needs both multiline comment delimiters or none", d.FileType)
+		}
+		for _, keyword := range d.Keywords {
+			if keyword == "" || keyword == "|" {
+				return fmt.Errorf("syntax %s has an empty keyword", d.FileType)
+			}
+		}
+		for _, delimiter := range d.MultilineStrings {
+			if delimiter == "" {
+				return fmt.Errorf("syntax %s has an empty multiline string delimiter", d.FileType)
+			}
 		}
 
-		row := E.rows[current]
-		match := strings.Index(row.render, query)
-		if match != -1 {
-			lastMatch = current
-			E.y = current
-			E.x = Render2X(&row, match)
-			E.offRow = len(E.rows)
+		syntaxes = append(syntaxes, EditorSyntax{
+			fileType:               d.FileType,
+			fileMatch:              d.FileMatch,
+			keywords:               d.Keywords,
+			singleLineCommentStart: d.SingleLineCommentStart,
+			multilineCommentStart:  d.MultilineCommentStart,
+			multilineCommentEnd:    d.MultilineCommentEnd,
+			multilineStrings:       d.MultilineStrings,
+			flags:                  d.Flags,
+		})
+	}
+
+	HighlightDatabase = append(HighlightDatabase, syntaxes...)
+	return nil
+}
+
+/* indent */
 
-			highlightRowIndex = current
-			highlightRowContent = make([]int, len(row.highlight))
-			copy(highlightRowContent, row.highlight)
+func validTabMode(mode string) bool {
+	switch mode {
+	case TabModeLiteral, TabModeSpaces, TabModeStop:
+		return true
+	}
+	return false
+}
+
+// parseIndentProfiles adds the profiles given like go=tab:4,python=spaces:4 to IndentProfiles
+func parseIndentProfiles(value string) error {
+	if value == "" {
+		return nil
+	}
 
-			for i := match; i < match+len(query); i++ {
-				row.highlight[i] = HighlightMatch
+	for _, item := range strings.Split(value, ",") {
+		var profile IndentProfile
+		fileType, setting, ok := cut(item, "=")
+		mode, width, _ := cut(setting, ":")
+		if !ok || !validTabMode(mode) {
+			return fmt.Errorf("%q, want filetype=tab|spaces|stop[:width]", item)
+		}
+
+		profile.tabMode = mode
+		profile.tabWidth = DefaultTabWidth
+		if width != "" {
+			n, err := strconv.Atoi(width)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("%q, invalid width %s", item, width)
 			}
+			profile.tabWidth = n
+		}
+		IndentProfiles[strings.TrimSpace(fileType)] = profile
+	}
+	return nil
+}
 
-			break
+func parseFormatters(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		fileType, command, ok := cut(item, "=")
+		if !ok || strings.TrimSpace(fileType) == "" || strings.TrimSpace(command) == "" {
+			return fmt.Errorf("%q, want filetype=command", item)
+		}
+		Formatters[strings.TrimSpace(fileType)] = command
+	}
+	return nil
+}
+
+// ApplyIndentProfile sets up indentation for the current buffer,
+// as detected from its content, or else for its file type
+func (e *EditorConfig) ApplyIndentProfile() {
+	profile := e.defaultIndent
+	if e.syntax != nil {
+		if p, ok := IndentProfiles[e.syntax.fileType]; ok {
+			profile = p
+		}
+	}
+	if detected := e.detectedIndent; detected != nil {
+		if detected.tabMode == TabModeLiteral {
+			profile.tabMode = TabModeLiteral
+		} else if profile.tabMode == TabModeLiteral {
+			profile.tabMode = TabModeSpaces
+		}
+		if detected.tabWidth > 0 {
+			profile.tabWidth = detected.tabWidth
 		}
 	}
 
-	StatusMessage("Not found %s", query)
+	tabWidth := e.tabWidth
+	e.tabMode = profile.tabMode
+	e.tabWidth = profile.tabWidth
+	if e.tabWidth <= 0 {
+		e.tabWidth = DefaultTabWidth
+	}
+	if e.tabWidth != tabWidth {
+		e.RenderRows()
+	}
 }
 
-/* Editor */
+// Retab converts the indentation of every row to tabs or to spaces,
+// the whitespace after the first other character is left alone
+func (e *EditorConfig) Retab(tabs bool) {
+	if !e.CheckWritable() {
+		return
+	}
 
-func ctrlKey(k byte) rune {
-	return rune(k & 0x1f)
+	changed := 0
+	for i := range e.rows {
+		line := e.rows[i].line
+		text := strings.TrimLeft(line, " \t")
+		var width int
+		for _, char := range line[:len(line)-len(text)] {
+			if char == '\t' {
+				width += e.tabWidth - width%e.tabWidth
+			} else {
+				width++
+			}
+		}
+
+		indent := strings.Repeat(" ", width)
+		if tabs {
+			indent = strings.Repeat("\t", width/e.tabWidth) + strings.Repeat(" ", width%e.tabWidth)
+		}
+		if indent+text != line {
+			e.SetLine(i, indent+text)
+			changed++
+		}
+	}
+
+	if tabs {
+		e.tabMode = TabModeLiteral
+		e.StatusMessage("Indented %d lines with tabs", changed)
+	} else {
+		if e.tabMode == TabModeLiteral {
+			e.tabMode = TabModeSpaces
+		}
+		e.StatusMessage("Indented %d lines with spaces", changed)
+	}
+	// the cursor may have been in the indentation
+	if row, ok := e.GetCurRow(); ok && e.x > len(row.line) {
+		e.x = len(row.line)
+	}
 }
 
-func editorScroll() {
-	E.renderX = 0
-	if row, ok := E.GetCurRow(); ok {
-		E.renderX = X2Render(row, E.x)
+// detectIndent guesses from the leading whitespace whether rows are indented
+// with tabs or spaces, and how many, it returns nil when that is not clear
+func detectIndent(rows []EditorRow) *IndentProfile {
+	var tabs, spaces int
+	steps := make(map[int]int)
+	previous := 0
+
+	for _, row := range rows {
+		if strings.TrimSpace(row.line) == "" {
+			continue
+		}
+
+		if strings.HasPrefix(row.line, "\t") {
+			tabs++
+			previous = 0
+			continue
+		}
+
+		indent := len(row.line) - len(strings.TrimLeft(row.line, " "))
+		if indent > 0 {
+			spaces++
+		}
+		// the step between a line and a more indented one is the indent width
+		if step := indent - previous; step > 1 && step <= 8 {
+			steps[step]++
+		}
+		previous = indent
 	}
 
-	if E.y < E.offRow {
-		E.offRow = E.y
+	switch {
+	case tabs > spaces:
+		return &IndentProfile{tabMode: TabModeLiteral}
+	case spaces > tabs:
+		width, count := 0, 0
+		for step, n := range steps {
+			if n > count || n == count && step < width {
+				width, count = step, n
+			}
+		}
+		if width == 0 {
+			return nil
+		}
+		return &IndentProfile{tabMode: TabModeSpaces, tabWidth: width}
 	}
-	if E.y >= E.offRow+E.screenRows {
-		E.offRow = E.y - E.screenRows + 1
+	return nil
+}
+
+/* undo */
+
+// UndoBegin starts collecting the changes of a key press into one undo step
+func (e *EditorConfig) UndoBegin() {
+	e.undoOpen = false
+	e.undoX, e.undoY = e.x, e.y+e.narrowFrom
+}
+
+// UndoEnd remembers where the cursor ended up after the changes of a key press
+func (e *EditorConfig) UndoEnd() {
+	if !e.undoOpen {
+		return
 	}
-	if E.renderX < E.offCol {
-		E.offCol = E.renderX
+
+	step := &e.undo[len(e.undo)-1]
+	step.afterX, step.afterY = e.x, e.y+e.narrowFrom
+	e.undoOpen = false
+}
+
+// RecordChange adds the replacement of the lines before, from row at,
+// with the lines after to the current undo step
+func (e *EditorConfig) RecordChange(at int, before, after []string) {
+	if e.undoLevels <= 0 {
+		return
 	}
-	if E.renderX >= E.offCol+E.screenCols {
-		E.offCol = E.renderX - E.screenCols + 1
+	if !e.undoOpen {
+		e.undo = append(e.undo, UndoStep{x: e.undoX, y: e.undoY})
+		if len(e.undo) > e.undoLevels {
+			e.undo = e.undo[len(e.undo)-e.undoLevels:]
+		}
+		e.undoOpen = true
 	}
+
+	// rows are counted from the top of the whole buffer, as narrowing may change
+	step := &e.undo[len(e.undo)-1]
+	step.changes = append(step.changes, UndoChange{at: at + e.narrowFrom, before: before, after: after})
+	e.redo = nil
 }
 
-func (e *EditorConfig) GetCurRow() (row *EditorRow, ok bool) {
-	if ok = e.y < len(e.rows); ok {
-		row = &e.rows[e.y]
+func (e *EditorConfig) Undo() {
+	if !e.CheckWritable() {
+		return
+	}
+	if len(e.undo) == 0 {
+		e.StatusMessage("Nothing to undo")
+		return
 	}
 
-	return
+	step := e.undo[len(e.undo)-1]
+	if !e.ApplyUndoStep(step, true) {
+		return
+	}
+	e.undo = e.undo[:len(e.undo)-1]
+	e.redo = append(e.redo, step)
+	e.GotoLine(step.y-e.narrowFrom+1, step.x+1)
 }
 
-func editorMoveCursor(key rune) {
-	row, ok := E.GetCurRow()
+func (e *EditorConfig) Redo() {
+	if !e.CheckWritable() {
+		return
+	}
+	if len(e.redo) == 0 {
+		e.StatusMessage("Nothing to redo")
+		return
+	}
+
+	step := e.redo[len(e.redo)-1]
+	if !e.ApplyUndoStep(step, false) {
+		return
+	}
+	e.redo = e.redo[:len(e.redo)-1]
+	e.undo = append(e.undo, step)
+	e.GotoLine(step.afterY-e.narrowFrom+1, step.afterX+1)
+}
 
-	switch key {
-	case ArrowLeft:
-		if E.x != 0 {
-			E.x--
-		} else if E.y > 0 {
-			// move to the end of the previous line
-			E.y--
-			E.x = len(E.rows[E.y].line)
+// ApplyUndoStep reverts the changes of step, or makes them again when undo is false
+func (e *EditorConfig) ApplyUndoStep(step UndoStep, undo bool) bool {
+	for _, change := range step.changes {
+		if change.at < e.narrowFrom || change.at > e.narrowFrom+len(e.rows) {
+			e.StatusMessage("The change is outside of the narrowed lines, press Alt-R to widen")
+			return false
 		}
-	case ArrowRight:
-		if ok && E.x < len(row.line) {
-			E.x++
-		} else if ok && E.x == len(row.line) {
-			// move to the start of the next line
-			E.y++
-			E.x = 0
+	}
+
+	if undo {
+		for i := len(step.changes) - 1; i >= 0; i-- {
+			change := step.changes[i]
+			e.SetRows(change.at-e.narrowFrom, len(change.after), change.before)
 		}
-	case ArrowUp:
-		if E.y != 0 {
-			E.y--
+	} else {
+		for _, change := range step.changes {
+			e.SetRows(change.at-e.narrowFrom, len(change.before), change.after)
 		}
-	case ArrowDown:
-		if E.y < len(E.rows) {
-			E.y++
+	}
+	return true
+}
+
+/* follow */
+
+func (e *EditorConfig) StartFollow() {
+	info, err := os.Stat(e.filename)
+	if err != nil {
+		e.StatusMessage("Cannot follow %s: %s", e.filename, err)
+		return
+	}
+
+	e.followOffset = info.Size()
+	e.followPending = ""
+	e.following = true
+	e.y = len(e.rows) - 1
+	if e.y < 0 {
+		e.y = 0
+	}
+	e.x = 0
+}
+
+func (e *EditorConfig) ToggleFollow() {
+	if !e.follow {
+		e.StatusMessage("Not in follow mode, start gim with -f")
+		return
+	}
+
+	e.following = !e.following
+	if e.following {
+		e.StatusMessage("Following %s", e.filename)
+		e.Follow()
+	} else {
+		e.StatusMessage("Stopped following, press Alt-f to resume")
+	}
+}
+
+// Follow appends the lines written to the file since the last poll,
+// it reports whether the buffer changed
+func (e *EditorConfig) Follow() bool {
+	if e.partial || e.narrowed {
+		// the end of the file is not loaded for the lines to go after,
+		// or hidden until widening, when they are read
+		return false
+	}
+	info, err := os.Stat(e.filename)
+	if err != nil || info.Size() == e.followOffset {
+		return false
+	}
+
+	if info.Size() < e.followOffset {
+		// truncated or rotated, start over
+		e.highlightSaved = nil
+		if err := e.Open(e.filename); err != nil {
+			e.StatusMessage("Can't reload %s", err)
+			return true
 		}
+		e.StartFollow()
+		return true
 	}
 
-	if row, ok = E.GetCurRow(); ok && E.x > len(row.line) {
-		E.x = len(row.line)
-	} else if !ok {
-		E.x = 0
+	file, err := os.Open(e.filename)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	data := make([]byte, info.Size()-e.followOffset)
+	n, _ := file.ReadAt(data, e.followOffset)
+	e.followOffset += int64(n)
+
+	// keep the unterminated tail until the rest of its line is written
+	text := e.followPending + string(data[:n])
+	complete := strings.LastIndexByte(text, '\n') + 1
+	e.followPending = text[complete:]
+	if complete == 0 {
+		return false
 	}
+
+	atBottom := e.y >= len(e.rows)-1
+	from := len(e.rows)
+	e.rows = e.loadRows(e.rows, bufio.NewReader(strings.NewReader(text[:complete])))
+	for i := from; i < len(e.rows); i++ {
+		e.RenderRow(&e.rows[i])
+	}
+	if e.partial {
+		e.StatusMessage("Only the first %d lines are loaded (read-only), press Alt-l to load fully", len(e.rows))
+	}
+
+	// keep scrolling unless the user moved up to read
+	if atBottom {
+		e.y = len(e.rows) - 1
+		e.x = 0
+	}
+	return true
 }
 
-func editorMapArrowKey(key rune) rune {
-	switch key {
-	case 'A':
-		return ArrowUp
-	case 'B':
-		return ArrowDown
-	case 'C':
-		return ArrowRight
-	case 'D':
-		return ArrowLeft
+/* jumplist */
+
+func (e *EditorConfig) PushJump() {
+	e.PushJumpAt(e.x, e.y)
+}
 
+// PushJumpAt records the position before a big motion,
+// dropping the positions that were jumped back over
+func (e *EditorConfig) PushJumpAt(x, y int) {
+	e.jumps = append(e.jumps[:e.jumpIndex], JumpPosition{filename: e.filename, x: x, y: e.narrowFrom + y})
+	if len(e.jumps) > MaxJumps {
+		e.jumps = e.jumps[1:]
 	}
-	return EscapeChar
+	e.jumpIndex = len(e.jumps)
 }
 
-func editorPrompt(prompt string, callback func(string, rune)) (string, bool) {
-	var buffer strings.Builder
+func (e *EditorConfig) JumpBack() {
+	if e.jumpIndex == len(e.jumps) {
+		// remember where we came from, so jumping forward can return here
+		e.PushJump()
+		e.jumpIndex--
+	}
+	if e.jumpIndex == 0 {
+		e.StatusMessage("Already at the oldest jump")
+		return
+	}
 
-	for {
-		StatusMessage(prompt, buffer.String())
-		editorRefreshScreen()
+	e.jumpIndex--
+	e.JumpTo(e.jumps[e.jumpIndex])
+}
 
-		char := editorReadKey()
-		if char == Enter {
-			StatusMessage("")
-			if callback != nil {
-				callback(buffer.String(), char)
-			}
-			return buffer.String(), true
-		} else if char == DelKey || char == ctrlKey('h') || char == Backspace {
-			if buffer.Len() == 0 {
-				continue
+func (e *EditorConfig) JumpForward() {
+	if e.jumpIndex >= len(e.jumps)-1 {
+		e.StatusMessage("Already at the newest jump")
+		return
+	}
+
+	e.jumpIndex++
+	e.JumpTo(e.jumps[e.jumpIndex])
+}
+
+func (e *EditorConfig) JumpTo(jump JumpPosition) {
+	i := e.FindBuffer(jump.filename)
+	if i == -1 {
+		e.StatusMessage("Jump target %s is not open", jump.filename)
+		return
+	}
+	e.SwitchBuffer(i)
+
+	// the buffer may have been edited since, it is clamped to what exists now
+	e.GotoLine(jump.y-e.narrowFrom+1, jump.x+1)
+}
+
+/* git */
+
+func (e *EditorConfig) RefreshGitBranch() {
+	e.gitBranch = ""
+	e.gitBranchAt = time.Now()
+	if !e.showBranch || e.Unnamed() {
+		return
+	}
+
+	e.gitBranch = gitBranch(e.filename)
+}
+
+// gitBranch reads the branch checked out in the repository containing
+// filename, walking up to the repository root, without running git
+func gitBranch(filename string) string {
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return ""
+	}
+
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		gitDir := filepath.Join(dir, ".git")
+		if info, err := os.Stat(gitDir); err == nil {
+			if !info.IsDir() {
+				// worktrees and submodules use a file pointing at the git dir
+				content, err := os.ReadFile(gitDir)
+				if err != nil {
+					return ""
+				}
+				gitDir = strings.TrimSpace(strings.TrimPrefix(string(content), "gitdir:"))
+				if !filepath.IsAbs(gitDir) {
+					gitDir = filepath.Join(dir, gitDir)
+				}
+			}
+
+			head, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+			if err != nil {
+				return ""
+			}
+
+			ref := strings.TrimSpace(string(head))
+			if strings.HasPrefix(ref, "ref: ") {
+				return strings.TrimPrefix(strings.TrimPrefix(ref, "ref: "), "refs/heads/")
+			}
+			// detached head
+			if len(ref) > 7 {
+				ref = ref[:7]
+			}
+			return ref
+		}
+
+		if dir == filepath.Dir(dir) {
+			return ""
+		}
+	}
+}
+
+/* filter */
+
+// Filter replaces the rows with what a shell command prints when given them,
+// narrowing first filters only some lines
+func (e *EditorConfig) Filter() {
+	if !e.CheckWritable() {
+		return
+	}
+	if e.hexMode {
+		e.StatusMessage("Can't filter in hex mode")
+		return
+	}
+	command, ok := e.PromptHistory("Filter through: %s (ESC to cancel, Alt-Up: history)", nil, &e.filterHistory)
+	if !ok || command == "" {
+		e.StatusMessage("Filter aborted")
+		return
+	}
+
+	lines, err := e.RunFilter(command)
+	if err != nil {
+		e.StatusMessage("Filter failed: %s", err)
+		return
+	}
+	e.ReplaceRows(0, len(e.rows), lines)
+	e.ClampCursor()
+	e.StatusMessage("Filtered %d lines through %s", len(lines), command)
+}
+
+// RunFilter runs command with the shell, the rows on its input,
+// and returns the lines of its output when it succeeds
+func (e *EditorConfig) RunFilter(command string) ([]string, error) {
+	var input strings.Builder
+	for _, row := range e.rows {
+		input.WriteString(row.line)
+		input.WriteString("\n")
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := osexec.Command("/bin/sh", "-c", command)
+	cmd.Stdin = strings.NewReader(input.String())
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	// the command gets the terminal the way it was before gim started
+	e.DisableRawMode()
+	err := cmd.Run()
+	e.EnableRawMode()
+	if err != nil {
+		// the first line of the errors tells more than the exit status
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			err = errors.New(strings.SplitN(message, "\n", 2)[0])
+		}
+		return nil, err
+	}
+
+	output := strings.TrimSuffix(stdout.String(), "\n")
+	if output == "" {
+		return nil, nil
+	}
+	lines := strings.Split(output, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	return lines, nil
+}
+
+/* hex */
+
+func (e *EditorConfig) HexOpen(filename string) {
+	data, err := os.ReadFile(filename)
+	if !errors.Is(err, fs.ErrNotExist) {
+		e.maybe(err)
+	}
+
+	e.hexData = data
+	e.hexCursor, e.hexNibble = 0, 0
+	e.filename = filename
+	e.StatFile()
+	e.RefreshGitBranch()
+}
+
+// HexScroll maps the byte under the cursor to the screen position
+func (e *EditorConfig) HexScroll() {
+	e.y = e.hexCursor / HexBytesPerRow
+	column := e.hexCursor % HexBytesPerRow
+	// offset, then two columns per byte separated by spaces and an extra space in the middle
+	e.renderX = 10 + column*3 + e.hexNibble
+	if column >= HexBytesPerRow/2 {
+		e.renderX++
+	}
+	e.offCol, e.offWrap = 0, 0
+
+	if e.y < e.offRow {
+		e.offRow = e.y
+	}
+	if e.y >= e.offRow+e.screenRows {
+		e.offRow = e.y - e.screenRows + 1
+	}
+}
+
+func (e *EditorConfig) DrawHexRows() {
+	var builder strings.Builder
+	for y := 0; y < e.screenRows; y++ {
+		e.writeBuf.WriteString(CleanLine)
+
+		offset := (y + e.offRow) * HexBytesPerRow
+		if offset < len(e.hexData) {
+			end := offset + HexBytesPerRow
+			if end > len(e.hexData) {
+				end = len(e.hexData)
+			}
+
+			builder.Reset()
+			builder.WriteString(fmt.Sprintf("%08x  ", offset))
+			for i := offset; i < offset+HexBytesPerRow; i++ {
+				if i < end {
+					builder.WriteString(fmt.Sprintf("%02x ", e.hexData[i]))
+				} else {
+					builder.WriteString("   ")
+				}
+				if i-offset == HexBytesPerRow/2-1 {
+					builder.WriteByte(' ')
+				}
+			}
+
+			builder.WriteString(" |")
+			for _, b := range e.hexData[offset:end] {
+				if b < 32 || b > 126 {
+					b = '.'
+				}
+				builder.WriteByte(b)
+			}
+			builder.WriteByte('|')
+
+			e.writeBuf.WriteString(truncate(builder.String(), e.screenCols))
+		} else {
+			e.writeBuf.WriteString(Tilde)
+		}
+		e.writeBuf.WriteString(NewLine)
+	}
+}
+
+// HexProcessKey handles a key press in hex mode,
+// it reports false for keys left to the normal key handling
+func (e *EditorConfig) HexProcessKey(c rune) bool {
+	last := len(e.hexData) - 1
+	if last < 0 {
+		last = 0
+	}
+
+	switch c {
+	case ctrlKey('q'), ctrlKey('s'):
+		return false
+	case ArrowLeft:
+		if e.hexNibble == 1 {
+			e.hexNibble = 0
+		} else if e.hexCursor > 0 {
+			e.hexCursor--
+		}
+	case ArrowRight:
+		if e.hexCursor < last {
+			e.hexCursor++
+		}
+		e.hexNibble = 0
+	case ArrowUp:
+		if e.hexCursor >= HexBytesPerRow {
+			e.hexCursor -= HexBytesPerRow
+		}
+	case ArrowDown:
+		if e.hexCursor+HexBytesPerRow <= last {
+			e.hexCursor += HexBytesPerRow
+		}
+	case PageUp:
+		e.hexCursor -= e.screenRows * HexBytesPerRow
+		if e.hexCursor < 0 {
+			e.hexCursor = 0
+		}
+	case PageDown:
+		e.hexCursor += e.screenRows * HexBytesPerRow
+		if e.hexCursor > last {
+			e.hexCursor = last
+		}
+	case HomeKey:
+		e.hexCursor -= e.hexCursor % HexBytesPerRow
+		e.hexNibble = 0
+	case EndKey:
+		e.hexCursor += HexBytesPerRow - 1 - e.hexCursor%HexBytesPerRow
+		if e.hexCursor > last {
+			e.hexCursor = last
+		}
+		e.hexNibble = 0
+	default:
+		value, err := strconv.ParseUint(string(c), 16, 8)
+		if err != nil || c >= AltModifier {
+			break
+		}
+		if len(e.hexData) == 0 {
+			e.StatusMessage("Nothing to edit in an empty file")
+			break
+		}
+		e.HexEditNibble(byte(value))
+	}
+
+	e.quitTimes = e.quitConfirm
+	return true
+}
+
+func (e *EditorConfig) HexEditNibble(value byte) {
+	b := e.hexData[e.hexCursor]
+	if e.hexNibble == 0 {
+		e.hexData[e.hexCursor] = value<<4 | b&0x0f
+		e.hexNibble = 1
+	} else {
+		e.hexData[e.hexCursor] = b&0xf0 | value
+		e.hexNibble = 0
+		if e.hexCursor < len(e.hexData)-1 {
+			e.hexCursor++
+		}
+	}
+	e.dirty = true
+}
+
+/* reflow */
+
+// a quote or comment prefix repeated on every line of a paragraph, like "> " or "// "
+var reflowPrefix = regexp.MustCompile(`^\s*((>|#+|//)\s*)*`)
+
+// a list marker only on the first line of a paragraph, like "- " or "1. "
+var reflowBullet = regexp.MustCompile(`^([-*+]|\d+[.)])\s+`)
+
+// Reflow rewraps the paragraph around the cursor to the text width
+func (e *EditorConfig) Reflow() {
+	if !e.CheckWritable() {
+		return
+	}
+
+	content := func(i int) string {
+		line := e.rows[i].line
+		return line[len(reflowPrefix.FindString(line)):]
+	}
+	isBlank := func(i int) bool {
+		return strings.TrimSpace(content(i)) == ""
+	}
+	// every list item is a paragraph of its own
+	isItem := func(i int) bool {
+		return reflowBullet.MatchString(content(i))
+	}
+	if e.y >= len(e.rows) || isBlank(e.y) {
+		e.StatusMessage("Not in a paragraph")
+		return
+	}
+
+	from, to := e.y, e.y+1
+	for from > 0 && !isItem(from) && !isBlank(from-1) {
+		from--
+	}
+	for to < len(e.rows) && !isItem(to) && !isBlank(to) {
+		to++
+	}
+
+	first := e.rows[from].line
+	prefix := reflowPrefix.FindString(first)
+	bullet := reflowBullet.FindString(first[len(prefix):])
+
+	var words []string
+	for i := from; i < to; i++ {
+		line := content(i)
+		if i == from {
+			line = line[len(bullet):]
+		}
+		words = append(words, strings.Fields(line)...)
+	}
+
+	lead := prefix + bullet
+	indent := prefix + strings.Repeat(" ", utf8.RuneCountInString(bullet))
+	var lines []string
+	var line strings.Builder
+	line.WriteString(lead)
+	width := e.renderWidth(lead)
+	empty := true
+	for _, word := range words {
+		wordWidth := e.renderWidth(word)
+		if !empty && width+1+wordWidth > e.textWidth {
+			lines = append(lines, line.String())
+			line.Reset()
+			line.WriteString(indent)
+			width = e.renderWidth(indent)
+			empty = true
+		}
+		if !empty {
+			line.WriteByte(' ')
+			width++
+		}
+		line.WriteString(word)
+		width += wordWidth
+		empty = false
+	}
+	lines = append(lines, line.String())
+
+	e.ReplaceRows(from, to, lines)
+	e.y, e.x = from, 0
+}
+
+// renderWidth is the number of columns s takes on screen
+func (e *EditorConfig) renderWidth(s string) int {
+	var width int
+	for _, char := range s {
+		if char == '\t' {
+			width += e.tabWidth - width%e.tabWidth
+		} else {
+			width += runeWidth(char)
+		}
+	}
+	return width
+}
+
+/* buffers */
+
+// StoreBuffer saves the state of the current buffer into the buffer list
+func (e *EditorConfig) StoreBuffer() {
+	e.buffers[e.buffer] = EditorBuffer{
+		filename:       e.filename,
+		rows:           e.rows,
+		x:              e.x,
+		y:              e.y,
+		offRow:         e.offRow,
+		offCol:         e.offCol,
+		offWrap:        e.offWrap,
+		syntax:         e.syntax,
+		dirty:          e.dirty,
+		narrowed:       e.narrowed,
+		narrowFrom:     e.narrowFrom,
+		narrowHead:     e.narrowHead,
+		narrowTail:     e.narrowTail,
+		partial:        e.partial,
+		noHighlight:    e.noHighlight,
+		highlighted:    e.highlighted,
+		follow:         e.follow,
+		following:      e.following,
+		followOffset:   e.followOffset,
+		followPending:  e.followPending,
+		detectedIndent: e.detectedIndent,
+		undo:           e.undo,
+		redo:           e.redo,
+		newline:        e.newline,
+		noFinalNewline: e.noFinalNewline,
+		diskTime:       e.diskTime,
+		diskSize:       e.diskSize,
+	}
+}
+
+// LoadBuffer makes the i-th buffer of the list the current one
+func (e *EditorConfig) LoadBuffer(i int) {
+	if e.split {
+		// the panes are views into a single buffer
+		e.ToggleSplit()
+	}
+
+	b := e.buffers[i]
+	e.buffer = i
+	e.filename = b.filename
+	e.rows = b.rows
+	e.x, e.y = b.x, b.y
+	e.offRow, e.offCol, e.offWrap = b.offRow, b.offCol, b.offWrap
+	e.syntax = b.syntax
+	e.dirty = b.dirty
+	e.narrowed = b.narrowed
+	e.narrowFrom = b.narrowFrom
+	e.narrowHead, e.narrowTail = b.narrowHead, b.narrowTail
+	e.partial = b.partial
+	e.noHighlight = b.noHighlight
+	e.highlighted = b.highlighted
+	e.follow, e.following = b.follow, b.following
+	e.followOffset = b.followOffset
+	e.followPending = b.followPending
+	e.detectedIndent = b.detectedIndent
+	e.undo, e.redo = b.undo, b.redo
+	e.newline, e.noFinalNewline = b.newline, b.noFinalNewline
+	e.diskTime, e.diskSize = b.diskTime, b.diskSize
+	e.RefreshGitBranch()
+	e.ApplyIndentProfile()
+}
+
+// FindBuffer returns the index of the buffer editing filename, or -1
+func (e *EditorConfig) FindBuffer(filename string) int {
+	if filename == e.filename {
+		return e.buffer
+	}
+	for i, b := range e.buffers {
+		if i != e.buffer && b.filename == filename {
+			return i
+		}
+	}
+	return -1
+}
+
+func (e *EditorConfig) SwitchBuffer(i int) {
+	if i == e.buffer {
+		return
+	}
+
+	e.StoreBuffer()
+	e.LoadBuffer(i)
+}
+
+func (e *EditorConfig) OpenBuffer() {
+	if e.hexMode {
+		e.StatusMessage("Multiple buffers are not supported in hex mode")
+		return
+	}
+
+	filename, ok := e.Prompt("Open: %s", nil)
+	if !ok || filename == "" {
+		return
+	}
+	e.OpenInBuffer(filename)
+}
+
+// OpenInBuffer switches to the buffer of filename, opening it in a new one if needed
+func (e *EditorConfig) OpenInBuffer(filename string) {
+	if i := e.FindBuffer(filename); i != -1 {
+		e.SwitchBuffer(i)
+		return
+	}
+	if info, err := os.Stat(filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		e.StatusMessage("Can't open %s", err)
+		return
+	} else if err == nil && info.IsDir() {
+		e.FindFileIn(filename)
+		return
+	}
+
+	if e.filename != EmptyFile || e.dirty || len(e.rows) > 0 {
+		// an untouched new buffer is used instead of kept around
+		e.StoreBuffer()
+		e.buffers = append(e.buffers, EditorBuffer{filename: EmptyFile})
+		e.LoadBuffer(len(e.buffers) - 1)
+	}
+	if err := e.Open(filename); err != nil {
+		e.StatusMessage("Can't open %s", err)
+	}
+}
+
+// AnyDirty reports whether any buffer has unsaved changes
+func (e *EditorConfig) AnyDirty() bool {
+	if e.dirty {
+		return true
+	}
+	for i, b := range e.buffers {
+		if i != e.buffer && b.dirty {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *EditorConfig) NextBuffer(delta int) {
+	if len(e.buffers) == 1 {
+		e.StatusMessage("No other buffer")
+		return
+	}
+
+	e.SwitchBuffer((e.buffer + delta + len(e.buffers)) % len(e.buffers))
+}
+
+// CloseBuffer closes the current buffer and goes back to the previous one
+func (e *EditorConfig) CloseBuffer() {
+	if e.dirty {
+		answer, ok := e.Prompt("Buffer has unsaved changes, close anyway? (y/n) %s", nil)
+		if !ok || !strings.EqualFold(answer, "y") {
+			return
+		}
+	}
+
+	if len(e.buffers) == 1 {
+		if e.quitOnClose {
+			e.exit(0)
+		}
+		e.buffers[0] = EditorBuffer{filename: EmptyFile}
+		e.LoadBuffer(0)
+		return
+	}
+
+	closed := e.buffer
+	e.buffers = append(e.buffers[:closed], e.buffers[closed+1:]...)
+	if closed > 0 {
+		closed--
+	}
+	e.LoadBuffer(closed)
+}
+
+/* centered */
+
+// TextCols is the number of screen columns for text
+func (e *EditorConfig) TextCols() int {
+	cols := e.screenCols - e.GutterWidth()
+	if e.centered && !e.hexMode && e.centerWidth > 0 && e.centerWidth < cols {
+		return e.centerWidth
+	}
+	return cols
+}
+
+// TextLeft is the screen column the text starts at, right after the gutter
+func (e *EditorConfig) TextLeft() int {
+	gutter := e.GutterWidth()
+	return (e.screenCols-gutter-e.TextCols())/2 + gutter
+}
+
+func (e *EditorConfig) ToggleCentered() {
+	e.centered = !e.centered
+	if e.centered {
+		e.StatusMessage("Centered column on")
+	} else {
+		e.StatusMessage("Centered column off")
+	}
+}
+
+/* gutter */
+
+// GutterWidth is the number of screen columns for line numbers,
+// as many as the digits of the last one and a separator
+func (e *EditorConfig) GutterWidth() int {
+	if !e.lineNumbers || e.hexMode {
+		return 0
+	}
+	total := len(e.narrowHead) + len(e.rows) + len(e.narrowTail)
+	return len(strconv.Itoa(total)) + 1
+}
+
+// DrawGutter draws the line number of row, or blanks when it is past the end
+func (e *EditorConfig) DrawGutter(row int) {
+	width := e.GutterWidth()
+	if width == 0 {
+		return
+	}
+	if row < 0 || row >= len(e.rows) {
+		e.writeBuf.WriteString(strings.Repeat(" ", width))
+		return
+	}
+
+	number := e.narrowFrom + row + 1
+	if e.relativeNumbers && row != e.y {
+		// the distance to the cursor line, which keeps its own number
+		number = row - e.y
+		if number < 0 {
+			number = -number
+		}
+	}
+	e.writeBuf.WriteString(TextColorDim)
+	e.writeBuf.WriteString(fmt.Sprintf("%*d ", width-1, number))
+	e.writeBuf.WriteString(TextColorDefault)
+}
+
+// ToggleLineNumbers goes from no line numbers to line numbers,
+// to relative line numbers and back
+func (e *EditorConfig) ToggleLineNumbers() {
+	switch {
+	case !e.lineNumbers:
+		e.lineNumbers, e.relativeNumbers = true, false
+		e.StatusMessage("Line numbers on")
+	case !e.relativeNumbers:
+		e.relativeNumbers = true
+		e.StatusMessage("Relative line numbers on")
+	default:
+		e.lineNumbers, e.relativeNumbers = false, false
+		e.StatusMessage("Line numbers off")
+	}
+}
+
+/* lint */
+
+// Lint counts the lines with trailing whitespace, with tabs and spaces mixed
+// in their indentation, and longer than the text width
+func (e *EditorConfig) Lint() {
+	var trailing, mixed, long int
+	e.lintIssues = nil
+	e.lintIndex = -1
+
+	for i, row := range e.rows {
+		issue := false
+		if trimmed := strings.TrimRight(row.line, " \t"); len(trimmed) != len(row.line) {
+			trailing++
+			issue = true
+		}
+		indent := row.line[:len(row.line)-len(strings.TrimLeft(row.line, " \t"))]
+		if strings.Contains(indent, " ") && strings.Contains(indent, "\t") {
+			mixed++
+			issue = true
+		}
+		if e.renderWidth(row.render) > e.textWidth {
+			long++
+			issue = true
+		}
+		if issue {
+			e.lintIssues = append(e.lintIssues, i)
+		}
+	}
+
+	if len(e.lintIssues) == 0 {
+		e.StatusMessage("Lint: no issues")
+		return
+	}
+	e.StatusMessage("Lint: %d trailing whitespace, %d mixed indent, %d longer than %d (Alt-K for next)",
+		trailing, mixed, long, e.textWidth)
+}
+
+// NextLintIssue moves to the next line found by the last lint
+func (e *EditorConfig) NextLintIssue() {
+	if len(e.lintIssues) == 0 {
+		e.StatusMessage("No lint issues, press Alt-k to lint")
+		return
+	}
+
+	e.lintIndex = (e.lintIndex + 1) % len(e.lintIssues)
+	e.PushJump()
+	e.GotoLine(e.lintIssues[e.lintIndex]+1, 1)
+	e.StatusMessage("Lint issue %d of %d", e.lintIndex+1, len(e.lintIssues))
+}
+
+/* split */
+
+// TextRows is the number of screen rows for text, in all panes together
+func (e *EditorConfig) TextRows() int {
+	if e.split {
+		return e.screenRows + 1 + e.otherPane.screenRows
+	}
+	return e.screenRows
+}
+
+// LayoutPanes divides the text rows between the top and the bottom pane,
+// with one row to separate them
+func (e *EditorConfig) LayoutPanes(total int) {
+	top := total / 2
+	bottom := total - top - 1
+	if e.pane == 0 {
+		e.screenRows, e.otherPane.screenRows = top, bottom
+	} else {
+		e.screenRows, e.otherPane.screenRows = bottom, top
+	}
+}
+
+func (e *EditorConfig) ToggleSplit() {
+	if e.hexMode {
+		e.StatusMessage("Split is not supported in hex mode")
+		return
+	}
+
+	if e.split {
+		e.screenRows = e.TextRows()
+		e.split = false
+		e.pane = 0
+		return
+	}
+
+	e.otherPane = EditorPane{x: e.x, y: e.y, offRow: e.offRow, offCol: e.offCol, offWrap: e.offWrap}
+	e.split = true
+	e.pane = 0
+	e.LayoutPanes(e.screenRows)
+}
+
+// SwapPane exchanges the view being edited with the other pane
+func (e *EditorConfig) SwapPane() {
+	other := e.otherPane
+	e.otherPane = EditorPane{x: e.x, y: e.y, offRow: e.offRow, offCol: e.offCol, offWrap: e.offWrap, screenRows: e.screenRows}
+	e.x, e.y = other.x, other.y
+	e.offRow, e.offCol, e.offWrap = other.offRow, other.offCol, other.offWrap
+	e.screenRows = other.screenRows
+}
+
+func (e *EditorConfig) SwitchPane() {
+	if !e.split {
+		e.StatusMessage("Screen is not split, press Alt-s to split")
+		return
+	}
+
+	e.SwapPane()
+	e.pane = 1 - e.pane
+
+	// the buffer may have been edited from the other pane
+	if e.y > e.LastRow() {
+		e.y = e.LastRow()
+	}
+	if row, ok := e.GetCurRow(); !ok {
+		e.x = 0
+	} else if e.x > len(row.line) {
+		e.x = len(row.line)
+	} else {
+		e.x = runeStart(row.line, e.x)
+	}
+}
+
+func (e *EditorConfig) DrawPanes() {
+	if e.pane == 1 {
+		e.SwapPane()
+		e.DrawRows()
+		e.SwapPane()
+	} else {
+		e.DrawRows()
+	}
+
+	e.writeBuf.WriteString(CleanLine)
+	e.writeBuf.WriteString(strings.Repeat("-", e.screenCols))
+	e.writeBuf.WriteString(NewLine)
+
+	if e.pane == 0 {
+		e.SwapPane()
+		e.DrawRows()
+		e.SwapPane()
+	} else {
+		e.DrawRows()
+	}
+}
+
+/* mouse */
+
+const (
+	MouseLeft      = 0
+	MouseWheelUp   = 64
+	MouseWheelDown = 65
+	MouseScroll    = 3
+)
+
+func (e *EditorConfig) Mouse() {
+	if e.hexMode || e.overlay != nil || !e.mouse.pressed {
+		return
+	}
+
+	switch e.mouse.button {
+	case MouseLeft:
+		e.Click(e.mouse.x, e.mouse.y)
+	case MouseWheelUp:
+		e.ScrollBy(-MouseScroll)
+	case MouseWheelDown:
+		e.ScrollBy(MouseScroll)
+	}
+}
+
+// Click moves the cursor to the character at a screen cell,
+// in the pane it is in when the screen is split
+func (e *EditorConfig) Click(x, y int) {
+	top := 0
+	if e.split {
+		otherTop := e.screenRows + 1
+		if e.pane == 1 {
+			top, otherTop = e.otherPane.screenRows+1, 0
+		}
+		if y >= otherTop && y < otherTop+e.otherPane.screenRows {
+			e.SwitchPane()
+			top = otherTop
+		}
+	}
+	if y < top || y >= top+e.screenRows {
+		return
+	}
+	col := x - e.TextLeft()
+	if col < 0 || col >= e.TextCols() {
+		return
+	}
+
+	at, render := e.offRow+y-top, e.offCol+col
+	if e.softWrap {
+		at, render = e.WrapPosition(y-top, col)
+	}
+	if at < 0 {
+		return
+	}
+	if at >= len(e.rows) {
+		at = len(e.rows) - 1
+	}
+	e.y, e.x = at, 0
+	if row, ok := e.GetCurRow(); ok {
+		e.x = e.Render2X(row, render)
+	} else {
+		e.y = 0
+	}
+}
+
+// ScrollBy scrolls the view by delta rows, taking the cursor along when it would leave it
+func (e *EditorConfig) ScrollBy(delta int) {
+	if e.typewriter {
+		// the view follows the cursor line
+		e.y += delta
+	} else {
+		e.offRow += delta
+		e.offWrap = 0
+		if e.offRow > len(e.rows)-1 {
+			e.offRow = len(e.rows) - 1
+		}
+		if e.offRow < 0 {
+			e.offRow = 0
+		}
+		if e.y < e.offRow {
+			e.y = e.offRow
+		}
+		if e.y >= e.offRow+e.screenRows {
+			e.y = e.offRow + e.screenRows - 1
+		}
+	}
+
+	if e.y > e.LastRow() {
+		e.y = e.LastRow()
+	}
+	if e.y < 0 {
+		e.y = 0
+	}
+	if row, ok := e.GetCurRow(); !ok {
+		e.x = 0
+	} else if e.x > len(row.line) {
+		e.x = len(row.line)
+	} else {
+		e.x = runeStart(row.line, e.x)
+	}
+}
+
+/* file finder */
+
+const (
+	FinderMaxDepth = 10
+	FinderMaxFiles = 20000
+)
+
+// FindFile lists the files under the current directory,
+// filtered as the query is typed, and opens the chosen one
+func (e *EditorConfig) FindFile() {
+	e.FindFileIn(".")
+}
+
+// FindFileIn is FindFile for the files under dir
+func (e *EditorConfig) FindFileIn(dir string) {
+	if e.hexMode {
+		e.StatusMessage("Multiple buffers are not supported in hex mode")
+		return
+	}
+
+	e.finder.Lock()
+	e.finder.files, e.finder.seen = nil, 0
+	e.finder.generation++
+	generation := e.finder.generation
+	e.finder.Unlock()
+	go e.finderCrawl(dir, generation)
+
+	e.finder.active = true
+	e.finderQuery = ""
+	e.finderMatches = nil
+	e.overlay = []string{}
+	e.overlaySelected = 0
+	prompt := "Find file: %s (Use ESC/Arrows/Enter)"
+	if dir != "." {
+		prompt = "Find file in " + strings.ReplaceAll(dir, "%", "%%") + ": %s (Use ESC/Arrows/Enter)"
+	}
+	_, ok := e.Prompt(prompt, e.FinderCallback)
+	e.finder.active = false
+	e.overlay = nil
+	e.finder.Lock()
+	e.finder.generation++
+	e.finder.Unlock()
+
+	// the file chosen is the one shown selected
+	if !ok || e.overlaySelected >= len(e.finderMatches) {
+		return
+	}
+	e.OpenInBuffer(filepath.Join(dir, e.finderMatches[e.overlaySelected]))
+}
+
+// isDirectory reports whether path is an existing directory
+func isDirectory(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func (e *EditorConfig) FinderCallback(query string, key rune) {
+	e.finderQuery = query
+	switch key {
+	case ArrowUp:
+		if e.overlaySelected > 0 {
+			e.overlaySelected--
+		}
+	case ArrowDown:
+		if e.overlaySelected < len(e.finderMatches)-1 {
+			e.overlaySelected++
+		}
+	case Enter, EscapeChar:
+	default:
+		e.overlaySelected = 0
+		e.FinderFilter(query)
+	}
+}
+
+// FinderUpdate picks up the files crawled since the last call,
+// it reports whether the list changed
+func (e *EditorConfig) FinderUpdate() bool {
+	e.finder.Lock()
+	count := len(e.finder.files)
+	e.finder.Unlock()
+	if count == e.finder.seen {
+		return false
+	}
+
+	// the selection stays on the same file as the list is sorted again
+	var selected string
+	if e.overlaySelected < len(e.finderMatches) {
+		selected = e.finderMatches[e.overlaySelected]
+	}
+	e.FinderFilter(e.finderQuery)
+	for i, file := range e.finderMatches {
+		if file == selected {
+			e.overlaySelected = i
+		}
+	}
+	return true
+}
+
+func (e *EditorConfig) FinderFilter(query string) {
+	e.finder.Lock()
+	files := e.finder.files
+	e.finder.seen = len(files)
+	e.finder.Unlock()
+
+	e.finderMatches = nil
+	for _, i := range fuzzyFilter(files, query) {
+		e.finderMatches = append(e.finderMatches, files[i])
+	}
+	if e.overlaySelected >= len(e.finderMatches) {
+		e.overlaySelected = 0
+	}
+	if e.finder.active {
+		e.overlay = e.finderMatches
+	}
+}
+
+// finderCrawl walks the tree under root, skipping .git and what .gitignore lists,
+// until the finder moves on from generation
+func (e *EditorConfig) finderCrawl(root string, generation int) {
+	ignore := readGitignore(filepath.Join(root, ".gitignore"))
+
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(root, path)
+		if rel == "." {
+			return nil
+		}
+		if entry.Name() == ".git" || gitignored(ignore, rel, entry.IsDir()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			if strings.Count(rel, string(filepath.Separator)) >= FinderMaxDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		e.finder.Lock()
+		defer e.finder.Unlock()
+		if e.finder.generation != generation {
+			return errors.New("finder closed")
+		}
+		e.finder.files = append(e.finder.files, rel)
+		if len(e.finder.files) >= FinderMaxFiles {
+			return errors.New("too many files")
+		}
+		return nil
+	})
+}
+
+func readGitignore(filename string) []string {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+
+	var patterns []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		// negated patterns are not supported
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns
+}
+
+// gitignored matches the common subset of .gitignore patterns:
+// globs on the name, globs on the path when they contain a slash, and a trailing slash for directories
+func gitignored(patterns []string, path string, isDir bool) bool {
+	path = filepath.ToSlash(path)
+	name := filepath.Base(path)
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/") {
+			if !isDir {
+				continue
+			}
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+
+		if strings.Contains(pattern, "/") {
+			if ok, _ := filepath.Match(strings.TrimPrefix(pattern, "/"), path); ok {
+				return true
+			}
+		} else if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+/* narrow */
+
+func (e *EditorConfig) Narrow() {
+	input, ok := e.Prompt("Narrow to lines (from-to): %s", nil)
+	if !ok {
+		return
+	}
+
+	var from, to int
+	if n, _ := fmt.Sscanf(strings.ReplaceAll(input, ",", "-"), "%d-%d", &from, &to); n != 2 || !e.NarrowTo(from, to) {
+		e.StatusMessage("Invalid line range %s", input)
+	}
+}
+
+// NarrowTo hides the rows outside of the lines from to, counted from 1,
+// and reports whether there are any lines in between
+func (e *EditorConfig) NarrowTo(from, to int) bool {
+	e.Widen()
+	if from < 1 {
+		from = 1
+	}
+	if to > len(e.rows) {
+		to = len(e.rows)
+	}
+	if from > to {
+		return false
+	}
+
+	// the rows around keep the highlighting they get from the rows before them
+	e.HighlightTo(to - 1)
+	rows := make([]EditorRow, to-from+1)
+	copy(rows, e.rows[from-1:to])
+	for i := range rows {
+		rows[i].idx = i
+	}
+
+	e.narrowHead = append([]EditorRow(nil), e.rows[:from-1]...)
+	e.narrowTail = append([]EditorRow(nil), e.rows[to:]...)
+	e.narrowFrom = from - 1
+	e.narrowed = true
+	e.rows = rows
+	e.highlighted = len(rows)
+
+	e.y -= e.narrowFrom
+	if e.y < 0 || e.y >= len(e.rows) {
+		e.y, e.x = 0, 0
+	}
+	e.offRow = 0
+	return true
+}
+
+func (e *EditorConfig) Widen() {
+	if !e.narrowed {
+		return
+	}
+
+	e.y += e.narrowFrom
+	// the rows after the region are highlighted again, what it leaves open may have changed
+	if e.highlighted > len(e.rows) {
+		e.highlighted = len(e.rows)
+	}
+	e.highlighted += e.narrowFrom
+	e.rows = e.AllRows()
+	for i := range e.rows {
+		e.rows[i].idx = i
+	}
+
+	e.narrowed = false
+	e.narrowFrom = 0
+	e.narrowHead, e.narrowTail = nil, nil
+}
+
+// AllRows returns the whole buffer, including the rows hidden by narrowing
+func (e *EditorConfig) AllRows() []EditorRow {
+	if !e.narrowed {
+		return e.rows
+	}
+
+	rows := make([]EditorRow, 0, len(e.narrowHead)+len(e.rows)+len(e.narrowTail))
+	rows = append(rows, e.narrowHead...)
+	rows = append(rows, e.rows...)
+	rows = append(rows, e.narrowTail...)
+	return rows
+}
+
+/* find */
+func (e *EditorConfig) Find() {
+	e.searchOrigin, e.searchDirection = -1, 1
+	e.Search("Search: %s (ESC/Arrows/Enter, Tab: ignore case, Alt-r: regexp, Alt-Up: history)")
+}
+
+// FindBackward searches upward from the cursor first
+func (e *EditorConfig) FindBackward() {
+	e.searchOrigin, e.searchDirection = e.y, -1
+	e.Search("Search backward: %s (ESC/Arrows/Enter, Tab: ignore case, Alt-r: regexp, Alt-Up: history)")
+}
+
+func (e *EditorConfig) Search(prompt string) {
+	lastX, lastY := e.x, e.y
+	e.searchStart = EditorPane{x: e.x, y: e.y, offCol: e.offCol, offRow: e.offRow, offWrap: e.offWrap}
+	query, ok := e.PromptHistory(prompt, e.FindCallBack, &e.searchHistory)
+	if ok && query != "" {
+		e.lastQuery = query
+	}
+
+	if !ok {
+		e.SearchRestart()
+	} else if e.x != lastX || e.y != lastY {
+		e.PushJumpAt(lastX, lastY)
+	}
+	e.searchStatus = ""
+	e.matchBefore = nil
+}
+
+// SearchRestart puts the cursor and view back to before searching
+func (e *EditorConfig) SearchRestart() {
+	e.x, e.y = e.searchStart.x, e.searchStart.y
+	e.offCol, e.offRow, e.offWrap = e.searchStart.offCol, e.searchStart.offRow, e.searchStart.offWrap
+}
+
+// FindNext repeats the last search from the cursor,
+// in the direction it went or the opposite one
+func (e *EditorConfig) FindNext(reverse bool) {
+	if e.lastQuery == "" {
+		e.StatusMessage("No previous search")
+		return
+	}
+
+	key := rune(ArrowDown)
+	if (e.lastDirection == -1) != reverse {
+		key = ArrowUp
+	}
+
+	lastX, lastY := e.x, e.y
+	e.lastMatch = e.y
+	e.FindCallBack(e.lastQuery, key)
+	status, found := e.searchStatus, e.searchFound
+	// only move the cursor, don't leave the match highlighted
+	lastDirection := e.lastDirection
+	e.FindCallBack(e.lastQuery, Enter)
+	e.lastDirection = lastDirection
+	e.searchStatus = ""
+	e.matchBefore = nil
+
+	if !found {
+		e.StatusMessage("Not found %s", e.lastQuery)
+		return
+	}
+	e.StatusMessage("%s", status)
+	if e.x != lastX || e.y != lastY {
+		e.PushJumpAt(lastX, lastY)
+	}
+}
+
+func (e *EditorConfig) CountMatches(query string) {
+	if query == e.matchQuery && len(e.matchBefore) == len(e.rows)+1 {
+		return
+	}
+
+	e.matchQuery = query
+	e.matchBefore = make([]int, len(e.rows)+1)
+	for i, row := range e.rows {
+		e.matchBefore[i+1] = e.matchBefore[i] + e.searchCount(row.line, query)
+	}
+}
+
+// HighlightMatch highlights the bytes from, to of the line of row at as the current match,
+// until ClearMatch
+func (e *EditorConfig) HighlightMatch(at, from, to int) {
+	e.ClearMatch()
+	e.MarkMatch(at, from, to, HighlightCurrentMatch)
+}
+
+// HighlightMatches highlights the current match like HighlightMatch,
+// and the other matches of query on the rows that may be on screen with it
+func (e *EditorConfig) HighlightMatches(query string, at, from, to int) {
+	e.ClearMatch()
+
+	first, last := at-e.screenRows, at+e.screenRows
+	if first < 0 {
+		first = 0
+	}
+	if last > len(e.rows)-1 {
+		last = len(e.rows) - 1
+	}
+	for i := first; i <= last; i++ {
+		for _, match := range e.searchAllIndex(e.rows[i].line, query) {
+			e.MarkMatch(i, match[0], match[1], HighlightMatch)
+		}
+	}
+	e.MarkMatch(at, from, to, HighlightCurrentMatch)
+}
+
+// MarkMatch highlights the bytes from, to of the line of row at with hl,
+// where they are drawn in its render
+func (e *EditorConfig) MarkMatch(at, from, to, hl int) {
+	e.HighlightTo(at)
+	row := &e.rows[at]
+	from, to = e.renderOffset(row, from), e.renderOffset(row, to)
+	if _, ok := e.highlightSaved[at]; !ok {
+		if e.highlightSaved == nil {
+			e.highlightSaved = make(map[int][]int)
+		}
+		e.highlightSaved[at] = append([]int(nil), row.highlight...)
+	}
+
+	for i := from; i < to; i++ {
+		row.highlight[i] = hl
+	}
+	row.drawValid = false
+}
+
+func (e *EditorConfig) ClearMatch() {
+	for at, highlight := range e.highlightSaved {
+		if at < len(e.rows) && len(highlight) == len(e.rows[at].highlight) {
+			e.rows[at].highlight = highlight
+			e.rows[at].drawValid = false
+		}
+	}
+	e.highlightSaved = nil
+}
+
+// brackets pairs each opening bracket with its closing one
+const brackets = "()[]{}"
+
+// FindBracket finds the bracket matching the one at x, y, going forward
+// from an opening bracket and backward from a closing one, without looking past
+// the rows first to last. Brackets in strings and comments are skipped, unless
+// the one at x, y is in a string or comment itself
+func (e *EditorConfig) FindBracket(x, y, first, last int) (int, int, bool) {
+	if y >= len(e.rows) || x >= len(e.rows[y].line) {
+		return 0, 0, false
+	}
+	i := strings.IndexByte(brackets, e.rows[y].line[x])
+	if i == -1 {
+		return 0, 0, false
+	}
+
+	same, other, step := brackets[i], brackets[i^1], 1
+	if i%2 == 1 {
+		step = -1
+	}
+	skip := !e.InLiteral(&e.rows[y], x)
+	depth := 0
+	for y >= first && y <= last {
+		line := e.rows[y].line
+		for ; x >= 0 && x < len(line); x += step {
+			if c := line[x]; c != same && c != other || skip && e.InLiteral(&e.rows[y], x) {
+				continue
+			}
+			switch line[x] {
+			case same:
+				depth++
+			case other:
+				depth--
+				if depth == 0 {
+					return x, y, true
+				}
+			}
+		}
+		y += step
+		if y >= 0 && y < len(e.rows) && step == -1 {
+			x = len(e.rows[y].line) - 1
+		} else {
+			x = 0
+		}
+	}
+	return 0, 0, false
+}
+
+// InLiteral reports whether the byte x of row is highlighted as part of a string or comment
+func (e *EditorConfig) InLiteral(row *EditorRow, x int) bool {
+	e.HighlightTo(row.idx)
+	index := e.renderOffset(row, x)
+	if index >= len(row.highlight) {
+		return false
+	}
+	switch row.highlight[index] {
+	case HighlightString, HighlightComment, HighlightMultilineComment:
+		return true
+	}
+	return false
+}
+
+// JumpToBracket moves the cursor to the bracket matching the one under it
+func (e *EditorConfig) JumpToBracket() {
+	x, y, ok := e.FindBracket(e.x, e.y, 0, len(e.rows)-1)
+	if !ok {
+		return
+	}
+	e.PushJump()
+	e.x, e.y = x, y
+}
+
+// HighlightBracket marks the bracket matching the one at the cursor,
+// restoring the highlight of the one marked before
+func (e *EditorConfig) HighlightBracket() {
+	if e.bracketSaved.marked {
+		e.bracketSaved.marked = false
+		// the row may have been highlighted again since
+		if at := e.bracketSaved.at; at < len(e.rows) && e.bracketSaved.index < len(e.rows[at].highlight) &&
+			e.rows[at].highlight[e.bracketSaved.index] == HighlightBracket {
+			e.rows[at].highlight[e.bracketSaved.index] = e.bracketSaved.highlight
+			e.rows[at].drawValid = false
+		}
+	}
+
+	// a match off screen would not be seen anyway
+	last := e.offRow + e.screenRows - 1
+	if last > len(e.rows)-1 {
+		last = len(e.rows) - 1
+	}
+	x, y, ok := e.FindBracket(e.x, e.y, e.offRow, last)
+	if !ok {
+		return
+	}
+	row := &e.rows[y]
+	index := e.renderOffset(row, x)
+	if index >= len(row.highlight) {
+		return
+	}
+	e.bracketSaved.marked = true
+	e.bracketSaved.at, e.bracketSaved.index = y, index
+	e.bracketSaved.highlight = row.highlight[index]
+	row.highlight[index] = HighlightBracket
+	row.drawValid = false
+}
+
+func (e *EditorConfig) FindCallBack(query string, key rune) {
+	e.ClearMatch()
+
+	if key == Enter || key == EscapeChar {
+		if key == Enter {
+			e.lastDirection = e.direction
+		}
+		e.lastMatch = -1
+		e.direction = 1
+		return
+	} else if key == ArrowRight || key == ArrowDown {
+		e.direction = 1
+	} else if key == ArrowLeft || key == ArrowUp {
+		e.direction = -1
+	} else {
+		if key == '\t' {
+			e.searchIgnoreCase = !e.searchIgnoreCase
+			e.matchQuery = ""
+		} else if key == altKey('r') {
+			e.searchRegexp = !e.searchRegexp
+			e.matchQuery = ""
+		}
+		if e.lastMatch == -1 {
+			e.lastMatch = e.searchOrigin
+			e.direction = e.searchDirection
+		} else {
+			// editing the query looks again from the current match,
+			// which stays where it is while it still matches
+			e.lastMatch -= e.direction
+		}
+	}
+
+	if e.lastMatch == -1 {
+		e.direction = 1
+	}
+	current := e.lastMatch
+
+	e.searchStatus = ""
+	e.searchFound = false
+	if query == "" {
+		// everything matches nothing, there is no match to go to or count
+		e.SearchRestart()
+		e.lastMatch = -1
+		e.searchStatus = strings.Join(e.SearchOptions(), " | ")
+		return
+	}
+	if _, err := e.searchPattern(query); err != nil {
+		var syntaxErr *syntax.Error
+		if errors.As(err, &syntaxErr) {
+			err = errors.New(string(syntaxErr.Code))
+		}
+		e.searchStatus = fmt.Sprintf("invalid regexp: %s", err)
+		return
+	}
+	e.CountMatches(query)
+
+	var wrapped string
+	for range e.rows {
+		current += e.direction
+		if current == -1 {
+			current = len(e.rows) - 1
+			wrapped = "search hit TOP, continuing at BOTTOM"
+		} else if current == len(e.rows) {
+			current = 0
+			wrapped = "search hit BOTTOM, continuing at TOP"
+		}
+
+		row := e.rows[current]
+		match, end := e.searchIndex(row.line, 0, query)
+		if match != -1 {
+			e.lastMatch = current
+			e.searchFound = true
+			e.y = current
+			e.x = match
+			e.offRow = len(e.rows)
+			e.HighlightMatches(query, current, match, end)
+
+			total := e.matchBefore[len(e.rows)]
+			e.searchStatus = fmt.Sprintf("match %d of %d", e.matchBefore[current]+1, total)
+			if wrapped != "" {
+				e.searchStatus = wrapped + " | " + e.searchStatus
+			}
+			break
+		}
+	}
+
+	// a macro being replayed stops at a failed search
+	e.macroStop = !e.searchFound && query != ""
+	if e.macroStop {
+		e.searchStatus = "not found"
+		e.StatusMessage("Not found %s", query)
+	}
+	for _, option := range e.SearchOptions() {
+		if e.searchStatus != "" {
+			e.searchStatus += " | "
+		}
+		e.searchStatus += option
+	}
+}
+
+// SearchOptions names the search options that are on
+func (e *EditorConfig) SearchOptions() []string {
+	var options []string
+	if e.searchRegexp {
+		options = append(options, "regexp")
+	}
+	if e.searchIgnoreCase {
+		options = append(options, "ignore case")
+	}
+	return options
+}
+
+// searchIndex returns where the first match of query in s from byte x starts and ends,
+// or -1. All of s is matched, for ^ and \b to see what comes before x
+func (e *EditorConfig) searchIndex(s string, x int, query string) (start, end int) {
+	for _, match := range e.searchAllIndex(s, query) {
+		if match[0] >= x {
+			return match[0], match[1]
+		}
+	}
+	return -1, -1
+}
+
+// searchAllIndex returns where query is found in s, like regexp.FindAllStringIndex,
+// as a regexp or ignoring case when the search does
+func (e *EditorConfig) searchAllIndex(s, query string) [][]int {
+	if query == "" {
+		return nil
+	}
+	if !e.searchIgnoreCase && !e.searchRegexp {
+		var matches [][]int
+		for start := 0; ; {
+			i := strings.Index(s[start:], query)
+			if i == -1 {
+				return matches
+			}
+			start += i
+			matches = append(matches, []int{start, start + len(query)})
+			start += len(query)
+		}
+	}
+
+	pattern, err := e.searchPattern(query)
+	if err != nil {
+		return nil
+	}
+	var matches [][]int
+	for _, match := range pattern.FindAllStringIndex(s, -1) {
+		// a match of nothing like a* is not one to show or replace
+		if match[1] > match[0] {
+			matches = append(matches, match)
+		}
+	}
+	return matches
+}
+
+// searchCount is the number of times query is found in s
+func (e *EditorConfig) searchCount(s, query string) int {
+	if query == "" {
+		return 0
+	}
+	if !e.searchIgnoreCase && !e.searchRegexp {
+		return strings.Count(s, query)
+	}
+	return len(e.searchAllIndex(s, query))
+}
+
+// searchPattern compiles query into a regexp with the search options
+func (e *EditorConfig) searchPattern(query string) (*regexp.Regexp, error) {
+	pattern := query
+	if !e.searchRegexp {
+		pattern = regexp.QuoteMeta(query)
+	}
+	if e.searchIgnoreCase {
+		// lowercasing may change the length of text, folding in a regexp keeps offsets right
+		pattern = "(?i)" + pattern
+	}
+
+	if e.searchCompiled == nil && e.searchCompileErr == nil || e.searchCompiledFrom != pattern {
+		e.searchCompiled, e.searchCompileErr = regexp.Compile(pattern)
+		e.searchCompiledFrom = pattern
+	}
+	return e.searchCompiled, e.searchCompileErr
+}
+
+/* clipboard */
+
+func (e *EditorConfig) CopyLine() {
+	if lines, ok := e.SelectedText(); ok {
+		e.clipboard, e.clipboardMode = lines, e.SelectionClipboardMode()
+		e.StatusMessage("Copied selection")
+		return
+	}
+	row, ok := e.GetCurRow()
+	if !ok {
+		return
+	}
+
+	e.clipboard, e.clipboardMode = []string{row.line}, ClipboardLines
+	e.StatusMessage("Copied 1 line")
+}
+
+func (e *EditorConfig) CutLine() {
+	if !e.CheckWritable() {
+		return
+	}
+	if lines, ok := e.SelectedText(); ok {
+		e.clipboard, e.clipboardMode = lines, e.SelectionClipboardMode()
+		e.DeleteSelection()
+		return
+	}
+	row, ok := e.GetCurRow()
+	if !ok {
+		return
+	}
+
+	if e.repeated > 0 && e.clipboardMode == ClipboardLines {
+		// cutting a count of lines keeps them all
+		e.clipboard = append(e.clipboard, row.line)
+	} else {
+		e.clipboard, e.clipboardMode = []string{row.line}, ClipboardLines
+	}
+	e.DeleteRow(e.y)
+	if e.y > e.LastRow() {
+		e.y = e.LastRow()
+	}
+	if row, ok := e.GetCurRow(); ok && e.x > len(row.line) {
+		e.x = len(row.line)
+	} else if !ok {
+		e.x = 0
+	}
+}
+
+// Paste inserts the clipboard below the cursor line, and moves onto it,
+// a copied selection goes in at the cursor instead
+func (e *EditorConfig) Paste() {
+	if !e.CheckWritable() {
+		return
+	}
+	if len(e.clipboard) == 0 {
+		e.StatusMessage("Nothing to paste")
+		return
+	}
+	switch e.clipboardMode {
+	case ClipboardInline:
+		e.DeleteSelection()
+		e.InsertLines(e.clipboard)
+		return
+	case ClipboardBlock:
+		e.DeleteSelection()
+		e.InsertBlock(e.clipboard)
+		return
+	}
+
+	at := e.y + 1
+	if at > len(e.rows) {
+		at = len(e.rows)
+	}
+	for i, line := range e.clipboard {
+		e.InsertRow(at+i, line)
+	}
+	e.y, e.x = at, 0
+}
+
+// InsertLines inserts lines at the cursor, the first one joining the text
+// before the cursor and the last one the text after it, the cursor ends up after them
+func (e *EditorConfig) InsertLines(lines []string) {
+	if e.y == len(e.rows) {
+		e.InsertRow(len(e.rows), "")
+	}
+	line := e.rows[e.y].line
+	inserted := append([]string(nil), lines...)
+	last := len(inserted) - 1
+	x := len(inserted[last])
+	if last == 0 {
+		x += e.x
+	}
+	inserted[0] = line[:e.x] + inserted[0]
+	inserted[last] += line[e.x:]
+
+	e.ReplaceRows(e.y, e.y+1, inserted)
+	e.y, e.x = e.y+last, x
+}
+
+// InsertBlock inserts lines one below the other at the column of the cursor,
+// padding the lines too short to reach it with spaces
+func (e *EditorConfig) InsertBlock(lines []string) {
+	col := 0
+	if row, ok := e.GetCurRow(); ok {
+		col = e.X2Render(row, e.x)
+	}
+	for i, text := range lines {
+		y := e.y + i
+		if y == len(e.rows) {
+			e.InsertRow(y, "")
+		}
+		line := e.rows[y].line
+		if short := col - e.renderWidth(line); short > 0 {
+			e.SetLine(y, line+strings.Repeat(" ", short)+text)
+		} else {
+			x := e.Render2X(&e.rows[y], col)
+			e.SetLine(y, line[:x]+text+line[x:])
+		}
+	}
+}
+
+/* selection */
+
+// unshiftKey is the movement a key pressed with Shift makes
+func unshiftKey(key rune) (rune, bool) {
+	switch key {
+	case ShiftLeft:
+		return ArrowLeft, true
+	case ShiftRight:
+		return ArrowRight, true
+	case ShiftUp:
+		return ArrowUp, true
+	case ShiftDown:
+		return ArrowDown, true
+	case ShiftHome:
+		return HomeKey, true
+	case ShiftEnd:
+		return EndKey, true
+	}
+	return key, false
+}
+
+// Selection is where the selection starts and ends, in rows and bytes
+// of their lines, ok is false without a selection
+func (e *EditorConfig) Selection() (fromX, fromY, toX, toY int, ok bool) {
+	if !e.selecting || e.hexMode || e.selX == e.x && e.selY == e.y {
+		return 0, 0, 0, 0, false
+	}
+	fromX, fromY, toX, toY = e.selX, e.selY, e.x, e.y
+	if fromY > toY || fromY == toY && fromX > toX {
+		fromX, fromY, toX, toY = toX, toY, fromX, fromY
+	}
+	if toY >= len(e.rows) {
+		return 0, 0, 0, 0, false
+	}
+	return fromX, fromY, toX, toY, true
+}
+
+// Block is the columns and rows of the block selection, ok is false
+// without one, the columns are render columns from left up to right
+func (e *EditorConfig) Block() (left, right, top, bottom int, ok bool) {
+	if !e.blockSelect {
+		return 0, 0, 0, 0, false
+	}
+	if _, top, _, bottom, ok = e.Selection(); !ok {
+		return 0, 0, 0, 0, false
+	}
+	left, right = e.X2Render(&e.rows[e.selY], e.selX), e.X2Render(&e.rows[e.y], e.x)
+	if left > right {
+		left, right = right, left
+	}
+	return left, right, top, bottom, true
+}
+
+// SelectionClipboardMode is how the selection is pasted once copied
+func (e *EditorConfig) SelectionClipboardMode() string {
+	if e.blockSelect {
+		return ClipboardBlock
+	}
+	return ClipboardInline
+}
+
+// ToggleBlockSelect switches Shift-arrows between selecting text
+// and selecting a block of columns
+func (e *EditorConfig) ToggleBlockSelect() {
+	e.blockSelect = !e.blockSelect
+	if e.blockSelect {
+		e.StatusMessage("Block selection on, typing goes into every line of the block")
+	} else {
+		e.StatusMessage("Block selection off")
+	}
+}
+
+// SelectionIn is the bytes of row.render that are selected, from is -1 when none are
+func (e *EditorConfig) SelectionIn(row *EditorRow) (from, to int) {
+	if left, right, top, bottom, ok := e.Block(); ok {
+		if row.idx < top || row.idx > bottom {
+			return -1, -1
+		}
+		return renderIndex(row, left), renderIndex(row, right)
+	}
+	fromX, fromY, toX, toY, ok := e.Selection()
+	if !ok || row.idx < fromY || row.idx > toY {
+		return -1, -1
+	}
+	from, to = 0, len(row.render)
+	if row.idx == fromY {
+		from = e.renderOffset(row, fromX)
+	}
+	if row.idx == toY {
+		to = e.renderOffset(row, toX)
+	}
+	return from, to
+}
+
+// SelectedText is the lines of the selection, the first and last ones
+// only from and up to where it starts and ends
+func (e *EditorConfig) SelectedText() ([]string, bool) {
+	if left, right, top, bottom, ok := e.Block(); ok {
+		var lines []string
+		for y := top; y <= bottom; y++ {
+			row := &e.rows[y]
+			lines = append(lines, row.line[e.Render2X(row, left):e.Render2X(row, right)])
+		}
+		return lines, true
+	}
+	fromX, fromY, toX, toY, ok := e.Selection()
+	if !ok {
+		return nil, false
+	}
+	if fromY == toY {
+		return []string{e.rows[fromY].line[fromX:toX]}, true
+	}
+
+	lines := []string{e.rows[fromY].line[fromX:]}
+	for y := fromY + 1; y < toY; y++ {
+		lines = append(lines, e.rows[y].line)
+	}
+	lines = append(lines, e.rows[toY].line[:toX])
+	return lines, true
+}
+
+// DeleteSelection deletes the selected text and reports whether there was any
+func (e *EditorConfig) DeleteSelection() bool {
+	if e.blockSelect {
+		return e.DeleteBlock()
+	}
+	fromX, fromY, toX, toY, ok := e.Selection()
+	if !ok || !e.CheckWritable() {
+		return false
+	}
+
+	line := e.rows[fromY].line[:fromX] + e.rows[toY].line[toX:]
+	e.ReplaceRows(fromY, toY+1, []string{line})
+	e.x, e.y = fromX, fromY
+	e.selecting = false
+	return true
+}
+
+// DeleteBlock deletes the text in the block selection, which is left
+// as a column for what is typed next
+func (e *EditorConfig) DeleteBlock() bool {
+	left, right, top, bottom, ok := e.Block()
+	if !ok || !e.CheckWritable() {
+		return false
+	}
+
+	for y := top; y <= bottom; y++ {
+		row := &e.rows[y]
+		if from, to := e.Render2X(row, left), e.Render2X(row, right); from < to {
+			e.SetLine(y, row.line[:from]+row.line[to:])
+		}
+	}
+	e.BlockColumn(left)
+	return true
+}
+
+// BlockInsert types char on every line of the block selection,
+// over the text in it, and reports whether there was a block
+func (e *EditorConfig) BlockInsert(char rune) bool {
+	left, right, top, bottom, ok := e.Block()
+	if !ok || !e.CheckWritable() {
+		return false
+	}
+	if left < right {
+		e.DeleteBlock()
+	}
+
+	for y := top; y <= bottom; y++ {
+		row := &e.rows[y]
+		if e.renderWidth(row.line) < left {
+			// lines too short to reach the block are left alone
+			continue
+		}
+		x := e.Render2X(row, left)
+		e.SetLine(y, row.line[:x]+string(char)+row.line[x:])
+	}
+	e.BlockColumn(left + runeWidth(char))
+	return true
+}
+
+// BlockBackspace deletes the text in the block selection, or the
+// character before it on every line when it is a column
+func (e *EditorConfig) BlockBackspace() bool {
+	left, right, top, bottom, ok := e.Block()
+	if !ok || !e.CheckWritable() {
+		return false
+	}
+	if left < right {
+		return e.DeleteBlock()
+	}
+
+	column := left
+	for y := top; y <= bottom; y++ {
+		row := &e.rows[y]
+		x := e.Render2X(row, left)
+		if x == 0 || e.renderWidth(row.line) < left {
+			continue
+		}
+		char, size := utf8.DecodeLastRuneInString(row.line[:x])
+		column = left - runeWidth(char)
+		e.SetLine(y, row.line[:x-size]+row.line[x:])
+	}
+	e.BlockColumn(column)
+	return true
+}
+
+// BlockColumn makes the block selection the column col of its rows, without text in it
+func (e *EditorConfig) BlockColumn(col int) {
+	e.selX = e.Render2X(&e.rows[e.selY], col)
+	e.x = e.Render2X(&e.rows[e.y], col)
+}
+
+/* replace */
+
+func (e *EditorConfig) Replace() {
+	if !e.CheckWritable() {
+		return
+	}
+
+	query, ok := e.PromptHistory("Replace: %s", nil, &e.searchHistory)
+	if !ok || query == "" {
+		return
+	}
+	if _, err := e.searchPattern(query); err != nil {
+		e.StatusMessage("Invalid regexp %s: %s", query, err)
+		return
+	}
+	replacement, ok := e.Prompt("Replace "+strings.ReplaceAll(query, "%", "%%")+" with: %s", nil)
+	if !ok {
+		return
+	}
+
+	originX, originY := e.x, e.y
+	x, y := e.x, e.y
+	var replaced int
+	var wrapped, all bool
+	defer e.ClearMatch()
+
+	for {
+		at, end := -1, -1
+		if y < len(e.rows) {
+			at, end = e.searchIndex(e.rows[y].line, x, query)
+		}
+		if at == -1 {
+			// go on with the next row, around the end of the buffer
+			y, x = y+1, 0
+			if y >= len(e.rows) {
+				if wrapped {
+					break
+				}
+				y, wrapped = 0, true
+			}
+			if wrapped && y > originY {
+				break
+			}
+			continue
+		}
+
+		if wrapped && y == originY && at >= originX {
+			break
+		}
+
+		e.x, e.y = at, y
+		if !all {
+			e.HighlightMatch(y, at, end)
+			e.StatusMessage("Replace this match? (y/n/a/q)")
+			e.RefreshScreen()
+
+			e.prompting = true
+			key := e.ReadKey()
+			e.prompting = false
+			switch key {
+			case 'y':
+			case 'a':
+				all = true
+			case 'n':
+				x = end
+				continue
+			default:
+				e.StatusMessage("Replaced %d occurrences", replaced)
+				return
+			}
+			e.ClearMatch()
+		}
+
+		line := e.rows[y].line
+		e.ReplaceRows(y, y+1, []string{line[:at] + replacement + line[end:]})
+		replaced++
+		x = at + len(replacement)
+		if wrapped && y == originY {
+			originX += len(replacement) - (end - at)
+		}
+	}
+
+	e.StatusMessage("Replaced %d occurrences", replaced)
+}
+
+/* Editor */
+
+func ctrlKey(k byte) rune {
+	return rune(k & 0x1f)
+}
+
+func altKey(k byte) rune {
+	return rune(k) + AltModifier
+}
+
+func (e *EditorConfig) Scroll() {
+	e.renderX = 0
+	if row, ok := e.GetCurRow(); ok {
+		e.renderX = e.X2Render(row, e.x)
+	}
+	if e.softWrap {
+		e.ScrollWrapped()
+		return
+	}
+
+	if e.typewriter {
+		// keep the cursor line in the middle, the text scrolls under it
+		e.offRow = e.y - e.screenRows/2
+	} else {
+		if e.offRow < 0 {
+			e.offRow = 0
+		}
+		if e.y < e.offRow {
+			e.offRow = e.y
+		}
+		if e.y >= e.offRow+e.screenRows {
+			e.offRow = e.y - e.screenRows + 1
+		}
+	}
+	if e.renderX < e.offCol {
+		e.offCol = e.renderX
+	}
+	if e.renderX >= e.offCol+e.TextCols() {
+		e.offCol = e.renderX - e.TextCols() + 1
+	}
+}
+
+// ScrollWrapped keeps the screen line of the cursor in view when
+// long lines are wrapped, the view starts at line offWrap of row offRow
+func (e *EditorConfig) ScrollWrapped() {
+	e.offCol = 0
+	line := 0
+	if row, ok := e.GetCurRow(); ok {
+		line = wrapLine(wrapStarts(row, e.TextCols()), e.renderX)
+	}
+
+	if e.typewriter {
+		e.offRow, e.offWrap = e.y-e.screenRows/2, 0
+		return
+	}
+	if e.offRow < 0 {
+		e.offRow, e.offWrap = 0, 0
+	}
+	if e.offWrap >= e.WrapLines(e.offRow) {
+		// the row got shorter
+		e.offWrap = e.WrapLines(e.offRow) - 1
+	}
+	if e.y < e.offRow || e.y == e.offRow && line < e.offWrap {
+		e.offRow, e.offWrap = e.y, line
+		return
+	}
+	if e.y >= e.offRow+e.screenRows {
+		// every row takes a line at least, start close to the cursor
+		e.offRow, e.offWrap = e.y-e.screenRows+1, 0
+	}
+	for e.ScreenLine(e.y, line) >= e.screenRows {
+		e.offWrap++
+		if e.offWrap >= e.WrapLines(e.offRow) {
+			e.offRow, e.offWrap = e.offRow+1, 0
+		}
+	}
+}
+
+// wrapStarts is the render columns the lines the row is wrapped into start at,
+// a wide character does not get split
+func wrapStarts(row *EditorRow, width int) []int {
+	if width < 1 {
+		width = 1
+	}
+	starts := []int{0}
+	var col int
+	for _, char := range row.render {
+		charWidth := runeWidth(char)
+		if start := starts[len(starts)-1]; col > start && col+charWidth > start+width {
+			starts = append(starts, col)
+		}
+		col += charWidth
+	}
+	return starts
+}
+
+// wrapLine is the line of starts the render column is on
+func wrapLine(starts []int, render int) int {
+	line := len(starts) - 1
+	for line > 0 && starts[line] > render {
+		line--
+	}
+	return line
+}
+
+// WrapLines is the number of screen lines row at takes
+func (e *EditorConfig) WrapLines(at int) int {
+	if at < 0 || at >= len(e.rows) {
+		return 1
+	}
+	return len(wrapStarts(&e.rows[at], e.TextCols()))
+}
+
+// ScreenLine is where the line-th line of row at is, counted
+// from the top of the view
+func (e *EditorConfig) ScreenLine(at, line int) int {
+	n := line - e.offWrap
+	for i := e.offRow; i < at; i++ {
+		n += e.WrapLines(i)
+	}
+	return n
+}
+
+// WrapPosition is the row and render column shown at the screen
+// line y and column col of the view
+func (e *EditorConfig) WrapPosition(y, col int) (at, render int) {
+	at, line := e.offRow, e.offWrap
+	for ; y > 0; y-- {
+		if line++; line >= e.WrapLines(at) {
+			at, line = at+1, 0
+		}
+	}
+	if at < 0 || at >= len(e.rows) {
+		return at, col
+	}
+
+	starts := wrapStarts(&e.rows[at], e.TextCols())
+	render = starts[line] + col
+	if line+1 < len(starts) && render >= starts[line+1] {
+		// past the end of the line, onto the last character
+		render = starts[line+1] - 1
+	}
+	return at, render
+}
+
+// MoveWrapped moves the cursor to the screen line above or below
+// when long lines are wrapped, keeping its column on the screen
+func (e *EditorConfig) MoveWrapped(dir int) {
+	row, ok := e.GetCurRow()
+	if !ok {
+		return
+	}
+	width := e.TextCols()
+	render := e.X2Render(row, e.x)
+	starts := wrapStarts(row, width)
+	line := wrapLine(starts, render)
+	col := render - starts[line]
+
+	line += dir
+	if line < 0 {
+		if e.y == 0 {
+			return
+		}
+		e.y--
+		row = &e.rows[e.y]
+		starts = wrapStarts(row, width)
+		line = len(starts) - 1
+	} else if line >= len(starts) {
+		if e.y >= e.LastRow() {
+			return
+		}
+		e.y++
+		row = &e.rows[e.y]
+		starts = wrapStarts(row, width)
+		line = 0
+	}
+
+	render = starts[line] + col
+	if line+1 < len(starts) && render >= starts[line+1] {
+		render = starts[line+1] - 1
+	}
+	e.x = e.Render2X(row, render)
+}
+
+// WrapCursor is the screen line and column of the cursor in the view
+// when long lines are wrapped
+func (e *EditorConfig) WrapCursor() (y, x int) {
+	row, ok := e.GetCurRow()
+	if !ok {
+		return e.y - e.offRow, 0
+	}
+	starts := wrapStarts(row, e.TextCols())
+	line := wrapLine(starts, e.renderX)
+	return e.ScreenLine(e.y, line), e.renderX - starts[line]
+}
+
+// ClampCursor moves the cursor back into the buffer after rows changed under it
+func (e *EditorConfig) ClampCursor() {
+	if e.y > e.LastRow() {
+		e.y = e.LastRow()
+	}
+	if row, ok := e.GetCurRow(); !ok {
+		e.x = 0
+	} else if e.x > len(row.line) {
+		e.x = len(row.line)
+	} else {
+		e.x = runeStart(row.line, e.x)
+	}
+}
+
+// LastRow is the last row the cursor may be on, the cursor stays
+// on the first row of an empty buffer
+func (e *EditorConfig) LastRow() int {
+	if len(e.rows) == 0 {
+		return 0
+	}
+	return len(e.rows) - 1
+}
+
+func (e *EditorConfig) GetCurRow() (row *EditorRow, ok bool) {
+	if ok = e.y < len(e.rows); ok {
+		row = &e.rows[e.y]
+	}
+
+	return
+}
+
+// GotoLine moves the cursor to the 1-based line and column,
+// clamped to the buffer, a column below 1 is the start of the line
+func (e *EditorConfig) GotoLine(line, col int) {
+	e.y = line - 1
+	if e.y > len(e.rows)-1 {
+		e.y = len(e.rows) - 1
+	}
+	if e.y < 0 {
+		e.y = 0
+	}
+
+	e.x = col - 1
+	if e.x < 0 {
+		e.x = 0
+	}
+	if row, ok := e.GetCurRow(); !ok {
+		e.x = 0
+	} else if e.x > len(row.line) {
+		e.x = len(row.line)
+	} else {
+		e.x = runeStart(row.line, e.x)
+	}
+}
+
+// Goto prompts for a line number and moves the cursor to it
+func (e *EditorConfig) Goto() {
+	input, ok := e.Prompt("Go to line: %s", nil)
+	if !ok || input == "" {
+		return
+	}
+
+	line, err := strconv.Atoi(strings.TrimSpace(input))
+	if err != nil || line < 1 {
+		e.StatusMessage("Invalid line number %s", input)
+		return
+	}
+
+	e.PushJump()
+	// line numbers count the lines hidden by narrowing
+	e.GotoLine(line-e.narrowFrom, 1)
+	e.Scroll()
+}
+
+func (e *EditorConfig) MoveCursor(key rune) {
+	row, ok := e.GetCurRow()
+	lastX, lastY := e.x, e.y
+	defer func() {
+		// a macro being replayed stops at the edges of the buffer
+		if e.x == lastX && e.y == lastY {
+			e.macroStop = true
+		}
+	}()
+
+	switch key {
+	case ArrowLeft:
+		if e.x != 0 {
+			// step over the whole character, with its combining marks
+			for e.x > 0 {
+				char, size := utf8.DecodeLastRuneInString(row.line[:e.x])
+				e.x -= size
+				if runeWidth(char) > 0 {
+					break
+				}
+			}
+		} else if e.y > 0 {
+			// move to the end of the previous line
+			e.y--
+			e.x = len(e.rows[e.y].line)
+		}
+	case ArrowRight:
+		if ok && e.x < len(row.line) {
+			_, size := utf8.DecodeRuneInString(row.line[e.x:])
+			e.x += size
+			for e.x < len(row.line) {
+				char, size := utf8.DecodeRuneInString(row.line[e.x:])
+				if runeWidth(char) > 0 {
+					break
+				}
+				e.x += size
+			}
+		} else if ok && e.x == len(row.line) && e.y < e.LastRow() {
+			// move to the start of the next line
+			e.y++
+			e.x = 0
+		}
+	case ArrowUp:
+		if e.softWrap {
+			e.MoveWrapped(-1)
+		} else if e.y != 0 {
+			e.y--
+		}
+	case ArrowDown:
+		if e.softWrap {
+			e.MoveWrapped(1)
+		} else if e.y < e.LastRow() {
+			e.y++
+		}
+	case CtrlArrowLeft:
+		if e.x == 0 {
+			e.MoveCursor(ArrowLeft)
+			return
+		}
+		e.x = wordStart(row.line, e.x)
+	case CtrlArrowRight:
+		if !ok || e.x == len(row.line) {
+			e.MoveCursor(ArrowRight)
+			return
+		}
+		// over the rest of the word, then the separators after it
+		for e.x < len(row.line) && !isSeparator(rune(row.line[e.x])) {
+			e.x++
+		}
+		for e.x < len(row.line) && isSeparator(rune(row.line[e.x])) {
+			e.x++
+		}
+	}
+
+	if row, ok = e.GetCurRow(); ok && e.x > len(row.line) {
+		e.x = len(row.line)
+	} else if ok {
+		e.x = runeStart(row.line, e.x)
+	} else {
+		e.x = 0
+	}
+}
+
+// wordStart is where the word before x in line starts, going back over
+// the separators, then the word before them
+func wordStart(line string, x int) int {
+	for x > 0 && isSeparator(rune(line[x-1])) {
+		x--
+	}
+	for x > 0 && !isSeparator(rune(line[x-1])) {
+		x--
+	}
+	return x
+}
+
+func editorMapArrowKey(key rune) rune {
+	switch key {
+	case 'A':
+		return ArrowUp
+	case 'B':
+		return ArrowDown
+	case 'C':
+		return ArrowRight
+	case 'D':
+		return ArrowLeft
+
+	}
+	return EscapeChar
+}
+
+// ReadMouse reads the rest of an SGR mouse report into mouse
+func (e *EditorConfig) ReadMouse() rune {
+	var report []byte
+	for len(report) < 32 {
+		var oneMoreByte [1]byte
+		if size, _ := os.Stdin.Read(oneMoreByte[:]); size != 1 {
+			return EscapeChar
+		}
+
+		if oneMoreByte[0] == 'M' || oneMoreByte[0] == 'm' {
+			var button, x, y int
+			if n, _ := fmt.Sscanf(string(report), "%d;%d;%d", &button, &x, &y); n != 3 {
+				return EscapeChar
+			}
+			e.mouse.button, e.mouse.x, e.mouse.y = button, x-1, y-1
+			e.mouse.pressed = oneMoreByte[0] == 'M'
+			return MouseEvent
+		}
+		report = append(report, oneMoreByte[0])
+	}
+	return EscapeChar
+}
+
+func editorMapAltArrowKey(key rune) rune {
+	switch key {
+	case 'A':
+		return AltArrowUp
+	case 'B':
+		return AltArrowDown
+	}
+	return EscapeChar
+}
+
+func editorMapShiftKey(key rune) rune {
+	switch key {
+	case 'A':
+		return ShiftUp
+	case 'B':
+		return ShiftDown
+	case 'C':
+		return ShiftRight
+	case 'D':
+		return ShiftLeft
+	case 'H':
+		return ShiftHome
+	case 'F':
+		return ShiftEnd
+	}
+	return EscapeChar
+}
+
+func editorMapCtrlArrowKey(key rune) rune {
+	switch key {
+	case 'C':
+		return CtrlArrowRight
+	case 'D':
+		return CtrlArrowLeft
+	}
+	return EscapeChar
+}
+
+func (e *EditorConfig) Prompt(prompt string, callback func(string, rune)) (string, bool) {
+	return e.PromptHistory(prompt, callback, nil)
+}
+
+// PromptHistory is Prompt recalling the earlier answers in history
+// with Alt-Up and Alt-Down, the answer is added to them
+func (e *EditorConfig) PromptHistory(prompt string, callback func(string, rune), history *[]string) (string, bool) {
+	var buffer strings.Builder
+	e.prompting = true
+	defer func() { e.prompting = false }()
+
+	// past the last answer is what was typed before going through them
+	var recalled int
+	var typed string
+	if history != nil {
+		recalled = len(*history)
+	}
+
+	for {
+		e.StatusMessage(prompt, buffer.String())
+		e.RefreshScreen()
+
+		char := e.ReadKey()
+		if char == Enter {
+			e.StatusMessage("")
+			if callback != nil {
+				callback(buffer.String(), char)
+			}
+			if history != nil && buffer.Len() > 0 {
+				editorAddHistory(history, buffer.String())
+			}
+			return buffer.String(), true
+		} else if history != nil && (char == AltArrowUp || char == AltArrowDown) {
+			if char == AltArrowUp && recalled > 0 {
+				if recalled == len(*history) {
+					typed = buffer.String()
+				}
+				recalled--
+			} else if char == AltArrowDown && recalled < len(*history) {
+				recalled++
+			} else {
+				continue
+			}
+			buffer = strings.Builder{}
+			if recalled < len(*history) {
+				buffer.WriteString((*history)[recalled])
+			} else {
+				buffer.WriteString(typed)
+			}
+		} else if char == DelKey || char == ctrlKey('h') || char == Backspace {
+			if buffer.Len() == 0 {
+				continue
+			}
+			_, size := utf8.DecodeLastRuneInString(buffer.String())
+			last := buffer.String()[:buffer.Len()-size]
+			buffer = strings.Builder{}
+			buffer.WriteString(last)
+		} else if char == EscapeChar {
+			e.StatusMessage("")
+			if callback != nil {
+				callback(buffer.String(), char)
+			}
+			return "", false
+		} else if !unicode.IsControl(char) && utf8.ValidRune(char) {
+			buffer.WriteRune(char)
+		}
+		if callback != nil {
+			callback(buffer.String(), char)
+		}
+	}
+}
+
+// editorAddHistory adds answer as the last one of history, moving it there if it was already in
+func editorAddHistory(history *[]string, answer string) {
+	for i, earlier := range *history {
+		if earlier == answer {
+			*history = append((*history)[:i], (*history)[i+1:]...)
+			break
+		}
+	}
+	*history = append(*history, answer)
+	if len(*history) > MaxPromptHistory {
+		*history = (*history)[1:]
+	}
+}
+
+func (e *EditorConfig) InsertRow(at int, line string) {
+	if at < 0 || at > len(e.rows) {
+		return
+	}
+	e.RecordChange(at, nil, []string{line})
+
+	// the rows from at move down by one, in place when there is room
+	e.rows = append(e.rows, EditorRow{})
+	copy(e.rows[at+1:], e.rows[at:])
+	e.rows[at] = EditorRow{line: line}
+	for i := at; i < len(e.rows); i++ {
+		e.rows[i].idx = i
+	}
+
+	if at < e.highlighted {
+		e.highlighted++
+	}
+	e.RenderRow(&e.rows[at])
+	e.dirty = true
+}
+
+func (e *EditorConfig) DeleteRow(at int) {
+	if at < 0 || at >= len(e.rows) {
+		return
+	}
+	e.RecordChange(at, []string{e.rows[at].line}, nil)
+
+	// the rows after at move up by one
+	copy(e.rows[at:], e.rows[at+1:])
+	e.rows[len(e.rows)-1] = EditorRow{}
+	e.rows = e.rows[:len(e.rows)-1]
+	for i := at; i < len(e.rows); i++ {
+		e.rows[i].idx = i
+	}
+	// what comments are open after it may have changed
+	if at < e.highlighted {
+		e.highlighted = at
+	}
+	e.dirty = true
+}
+
+// ReplaceRows replaces the rows in [from, to) with lines
+func (e *EditorConfig) ReplaceRows(from, to int, lines []string) {
+	if from < 0 || to > len(e.rows) || from > to {
+		return
+	}
+
+	before := make([]string, 0, to-from)
+	for _, row := range e.rows[from:to] {
+		before = append(before, row.line)
+	}
+	e.RecordChange(from, before, lines)
+	e.SetRows(from, to-from, lines)
+}
+
+// SetRows replaces n rows from row at with lines, without recording the change for undo
+func (e *EditorConfig) SetRows(at, n int, lines []string) {
+	from, to := at, at+n
+	if to > len(e.rows) {
+		to = len(e.rows)
+	}
+
+	// the rows after to move by the difference in place, and only from there on
+	// are the rows indexed again
+	end := from + len(lines)
+	switch grow := len(lines) - (to - from); {
+	case grow > 0:
+		e.rows = append(e.rows, make([]EditorRow, grow)...)
+		copy(e.rows[to+grow:], e.rows[to:len(e.rows)-grow])
+		end = len(e.rows)
+	case grow < 0:
+		copy(e.rows[to+grow:], e.rows[to:])
+		for i := len(e.rows) + grow; i < len(e.rows); i++ {
+			e.rows[i] = EditorRow{}
+		}
+		e.rows = e.rows[:len(e.rows)+grow]
+		end = len(e.rows)
+	}
+	for i, line := range lines {
+		e.rows[from+i] = EditorRow{line: line}
+	}
+	for i := from; i < end; i++ {
+		e.rows[i].idx = i
+	}
+
+	// what comments are open after the lines may have changed
+	if e.highlighted > from {
+		e.highlighted = from
+	}
+	for i := from; i < from+len(lines); i++ {
+		e.RenderRow(&e.rows[i])
+	}
+	e.dirty = true
+}
+
+// SetLine replaces the line of row at, recording the change for undo
+func (e *EditorConfig) SetLine(at int, line string) {
+	row := &e.rows[at]
+	if row.line == line {
+		return
+	}
+	e.RecordChange(at, []string{row.line}, []string{line})
+	row.line = line
+	e.RenderRow(row)
+	e.dirty = true
+}
+
+func (e *EditorConfig) RowAppendString(row *EditorRow, line string) {
+	row.line = row.line + line
+	e.RenderRow(row)
+
+	e.dirty = true
+}
+
+// RowDeleteChar deletes the character starting at byte at
+func (e *EditorConfig) RowDeleteChar(row *EditorRow, at int) {
+	if at < 0 || at >= len(row.line) {
+		return
+	}
+
+	_, size := utf8.DecodeRuneInString(row.line[at:])
+	var builder strings.Builder
+	builder.WriteString(row.line[:at])
+	builder.WriteString(row.line[at+size:])
+
+	row.line = builder.String()
+	e.RenderRow(row)
+	e.dirty = true
+}
+
+func (e *EditorConfig) RowInsertChar(row *EditorRow, at int, char rune) {
+	if at < 0 || at > len(row.line) {
+		at = len(row.line)
+	}
+
+	var builder strings.Builder
+	builder.Write([]byte(row.line[:at]))
+
+	builder.WriteRune(char)
+
+	if at < len(row.line) {
+		builder.Write([]byte(row.line[at:]))
+	}
+	row.line = builder.String()
+
+	e.RenderRow(row)
+	e.dirty = true
+}
+
+func (e *EditorConfig) RowInsertString(row *EditorRow, at int, str string) {
+	if at < 0 || at > len(row.line) {
+		at = len(row.line)
+	}
+
+	row.line = row.line[:at] + str + row.line[at:]
+
+	e.RenderRow(row)
+	e.dirty = true
+}
+
+func (e *EditorConfig) DrawRows() {
+	if e.softWrap {
+		e.DrawWrappedRows()
+		return
+	}
+
+	margin := strings.Repeat(" ", e.TextLeft()-e.GutterWidth())
+	for y := 0; y < e.screenRows; y++ {
+		e.writeBuf.WriteString(CleanLine)
+		e.writeBuf.WriteString(margin)
+
+		rowIndex := y + e.offRow
+		e.DrawGutter(rowIndex)
+		if rowIndex < 0 {
+			// above the first line in typewriter mode
+		} else if rowIndex < len(e.rows) && rowIndex == e.y && e.cursorLine {
+			e.DrawCursorLine(e.DrawRow(&e.rows[rowIndex], e.offCol))
+		} else if rowIndex < len(e.rows) {
+			e.writeBuf.WriteString(e.DrawRow(&e.rows[rowIndex], e.offCol))
+		} else {
+			if len(e.rows) == 0 && y == e.screenRows/3 {
+				e.DrawWelcome()
+			} else {
+				e.writeBuf.WriteString(Tilde)
+			}
+		}
+		e.writeBuf.WriteString(NewLine)
+	}
+}
+
+// DrawWrappedRows draws the rows longer than the screen over several
+// lines, only the first of them gets a line number
+func (e *EditorConfig) DrawWrappedRows() {
+	margin := strings.Repeat(" ", e.TextLeft()-e.GutterWidth())
+	width := e.TextCols()
+	at, line := e.offRow, e.offWrap
+	for y := 0; y < e.screenRows; y++ {
+		e.writeBuf.WriteString(CleanLine)
+		e.writeBuf.WriteString(margin)
+
+		if at < 0 || at >= len(e.rows) {
+			e.DrawGutter(at)
+			if at >= 0 {
+				if len(e.rows) == 0 && y == e.screenRows/3 {
+					e.DrawWelcome()
+				} else {
+					e.writeBuf.WriteString(Tilde)
+				}
+			}
+			at++
+			e.writeBuf.WriteString(NewLine)
+			continue
+		}
+
+		starts := wrapStarts(&e.rows[at], width)
+		if line >= len(starts) {
+			// the other pane changed the row
+			line = len(starts) - 1
+		}
+		if line == 0 {
+			e.DrawGutter(at)
+		} else {
+			e.DrawGutter(-1)
+		}
+		drawn := e.DrawRow(&e.rows[at], starts[line])
+		if at == e.y && e.cursorLine {
+			e.DrawCursorLine(drawn)
+		} else {
+			e.writeBuf.WriteString(drawn)
+		}
+		if line++; line == len(starts) {
+			at, line = at+1, 0
+		}
+		e.writeBuf.WriteString(NewLine)
+	}
+}
+
+// DrawCursorLine draws the row drawn as the cursor line, on the background
+// of the theme to the end of the screen line
+func (e *EditorConfig) DrawCursorLine(drawn string) {
+	color, ok := e.theme.colors[HighlightCurrentLine]
+	if !ok {
+		e.writeBuf.WriteString(drawn)
+		return
+	}
+
+	background := backgroundEscape(color, e.colorMode)
+	e.writeBuf.WriteString(background)
+	// resetting the colors within the row resets the background too
+	e.writeBuf.WriteString(strings.ReplaceAll(drawn, ColorBack, ColorBack+background))
+	e.writeBuf.WriteString(CleanLine)
+	e.writeBuf.WriteString(BackgroundDefault)
+}
+
+// DrawRow renders the part of the row from the render column offCol
+// that fits on screen with its colors, reusing the last result while nothing
+// it depends on has changed
+func (e *EditorConfig) DrawRow(row *EditorRow, offCol int) string {
+	width := e.TextCols()
+	selFrom, selTo := e.SelectionIn(row)
+	key := drawKey{render: row.render, offCol: offCol, width: width, showWhitespace: e.showWhitespace,
+		selFrom: selFrom, selTo: selTo}
+	if e.drawCache && row.drawValid && row.drawKey == key {
+		return row.drawCache
+	}
+
+	var symbols []rune
+	if e.showWhitespace {
+		symbols = e.whitespaceSymbols(row)
+	}
+
+	var builder strings.Builder
+	var col int
+	currentColor := ""
+	inverted := false
+	for i, char := range row.render {
+		charWidth := runeWidth(char)
+		if col < offCol {
+			// a wide character cut by the left edge leaves a gap
+			if col+charWidth > offCol {
+				builder.WriteString(strings.Repeat(" ", col+charWidth-offCol))
+			}
+			col += charWidth
+			continue
+		}
+		if col+charWidth > offCol+width {
+			break
+		}
+		col += charWidth
+
+		if unicode.IsControl(char) {
+			// the symbol stands out inverted, then the colors around it come back
+			builder.WriteString(ColorInverted)
+			builder.WriteRune(controlSymbol(char))
+			builder.WriteString(ColorBack)
+			if inverted {
+				builder.WriteString(ColorInverted)
+			}
+			builder.WriteString(currentColor)
+			continue
+		}
+		// the current search match stands out from the others, like the selection
+		isCurrent := row.highlight[i] == HighlightCurrentMatch || i >= selFrom && i < selTo
+		if isCurrent != inverted {
+			if isCurrent {
+				builder.WriteString(ColorInverted)
+			} else {
+				builder.WriteString(ColorBack)
+				currentColor = ""
+			}
+			inverted = isCurrent
+		}
+		if symbols != nil && symbols[i] != 0 {
+			if currentColor != TextColorDim {
+				builder.WriteString(TextColorDim)
+				currentColor = TextColorDim
+			}
+			builder.WriteRune(symbols[i])
+			continue
+		}
+		if row.highlight[i] == HighlightNormal {
+			if currentColor != "" {
+				builder.WriteString(TextColorDefault)
+				currentColor = ""
+			}
+		} else if color := e.SyntaxToColor(row.highlight[i]); color != currentColor {
+			currentColor = color
+			builder.WriteString(color)
+		}
+		builder.WriteRune(char)
+	}
+	if inverted {
+		builder.WriteString(ColorBack)
+	} else if currentColor != "" {
+		builder.WriteString(TextColorDefault)
+	}
+
+	row.drawKey = key
+	row.drawCache = builder.String()
+	row.drawValid = true
+	return row.drawCache
+}
+
+// controlSymbol is what is drawn for a control character, the letter typed with Ctrl for it like A
+// for Ctrl-A, or ? for the others
+func controlSymbol(char rune) rune {
+	if char < 32 {
+		return '@' + char
+	}
+	return '?'
+}
+
+// whitespaceSymbols returns what to draw instead of the bytes of row.render,
+// an arrow at the start of a tab and a dot for trailing spaces, 0 to draw the byte itself
+func (e *EditorConfig) whitespaceSymbols(row *EditorRow) []rune {
+	symbols := make([]rune, len(row.render))
+	trailing := len(strings.TrimRight(row.line, " \t"))
+
+	// render is the line with tabs expanded to spaces
+	var i, col int
+	for x, char := range row.line {
+		if i >= len(symbols) {
+			break
+		}
+		switch {
+		case char == '\t':
+			symbols[i] = '→'
+			spaces := e.tabWidth - col%e.tabWidth
+			i += spaces
+			col += spaces
+			continue
+		case char == ' ' && x >= trailing:
+			symbols[i] = '·'
+		}
+		i += utf8.RuneLen(char)
+		col += runeWidth(char)
+	}
+	return symbols
+}
+
+func (e *EditorConfig) ToggleWhitespace() {
+	e.showWhitespace = !e.showWhitespace
+	if e.showWhitespace {
+		e.StatusMessage("Showing whitespace")
+	} else {
+		e.StatusMessage("Hiding whitespace")
+	}
+}
+
+func (e *EditorConfig) DrawWelcome() {
+	welcome := fmt.Sprintf("gim editor -- version %s", GimVersion)
+	width := e.TextCols()
+	if len(welcome) > width {
+		welcome = welcome[:width]
+	}
+	padding := (width - len(welcome)) / 2
+	if padding > 0 {
+		e.writeBuf.WriteString(Tilde)
+	}
+	for ; padding > 0; padding-- {
+		e.writeBuf.WriteString(" ")
+	}
+
+	e.writeBuf.WriteString(welcome)
+}
+
+func (e *EditorConfig) DrawStatusBar() {
+	e.writeBuf.WriteString(ColorInverted)
+
+	var builder strings.Builder
+	if len(e.buffers) > 1 {
+		builder.WriteString(fmt.Sprintf("[%d/%d] ", e.buffer+1, len(e.buffers)))
+	}
+	if e.dirty {
+		builder.WriteString("[+] ")
+	}
+	builder.WriteString(e.filename)
+	builder.WriteString(" - ")
+	if e.hexMode {
+		builder.WriteString(strconv.Itoa(len(e.hexData)))
+		builder.WriteString(" bytes")
+	} else {
+		builder.WriteString(strconv.Itoa(len(e.rows)))
+		builder.WriteString(" lines")
+	}
+	if e.diskTime.IsZero() && !e.Unnamed() {
+		// not on disk until saved
+		builder.WriteString(" (new)")
+	}
+	if e.narrowed {
+		builder.WriteString(" (narrowed)")
+	}
+	if e.partial {
+		builder.WriteString(" (partial, read-only)")
+	}
+	if e.following {
+		builder.WriteString(" (following)")
+	} else if e.follow || e.readOnly && !e.partial {
+		builder.WriteString(" (read-only)")
+	}
+
+	leftStatus := builder.String()
+
+	builder.Reset()
+	if e.split {
+		builder.WriteString(fmt.Sprintf("pane %d/2 | ", e.pane+1))
+	}
+	if e.idleHint != "" {
+		builder.WriteString(e.idleHint)
+		builder.WriteString(" | ")
+	}
+	if e.searchStatus != "" {
+		builder.WriteString(e.searchStatus)
+		builder.WriteString(" | ")
+	}
+	if e.gitBranch != "" {
+		builder.WriteString("git:")
+		builder.WriteString(e.gitBranch)
+		builder.WriteString(" | ")
+	}
+	if e.hexMode {
+		builder.WriteString(fmt.Sprintf("0x%08x", e.hexCursor))
+	} else {
+		// line:column, the column counts bytes like compilers do in their messages
+		// and like file:line:column on the command line takes it
+		builder.WriteString(strconv.Itoa(e.narrowFrom + e.y + 1))
+		builder.WriteByte(byte(':'))
+		builder.WriteString(strconv.Itoa(e.x + 1))
+		builder.WriteByte(byte('/'))
+		builder.WriteString(strconv.Itoa(len(e.narrowHead) + len(e.rows) + len(e.narrowTail)))
+		builder.WriteByte(byte(' '))
+		builder.WriteString(e.ScrollPosition())
+	}
+
+	builder.WriteByte(byte(' '))
+	if !e.hexMode {
+		if e.tabMode == TabModeLiteral {
+			builder.WriteString("tabs")
+		} else {
+			builder.WriteString(fmt.Sprintf("spaces:%d", e.tabWidth))
+		}
+		if e.detectedIndent != nil {
+			builder.WriteString("(auto)")
+		}
+		builder.WriteByte(byte(' '))
+	}
+	if e.hexMode {
+		builder.WriteString("hex")
+	} else if e.syntax != nil {
+		builder.WriteString(e.syntax.fileType)
+	} else {
+		builder.WriteString("no ft")
+	}
+
+	rightStatus := builder.String()
+
+	e.writeBuf.WriteString(statusBarLine(leftStatus, rightStatus, e.screenCols))
+	e.writeBuf.WriteString(NewLine)
+
+	e.writeBuf.WriteString(ColorBack)
+}
+
+// ScrollPosition tells how far through the rows the screen is like vim does,
+// All when they all fit, Top and Bot at either end, or the percentage of rows above it
+func (e *EditorConfig) ScrollPosition() string {
+	above := e.offRow
+	if above < 0 {
+		// typewriter mode scrolls above the first line
+		above = 0
+	}
+	below := len(e.rows) - (e.offRow + e.screenRows)
+	if below < 0 {
+		below = 0
+	}
+
+	switch {
+	case above == 0 && below == 0:
+		return "All"
+	case above == 0:
+		return "Top"
+	case below == 0:
+		return "Bot"
+	}
+	return fmt.Sprintf("%d%%", above*100/(above+below))
+}
+
+// statusBarLine lays left and right out on a line of width columns, the right one
+// is kept whole as long as it fits and the left one is truncated before it
+func statusBarLine(left, right string, width int) string {
+	right = truncate(right, width)
+	room := width - stringWidth(right)
+	if right == "" {
+		left = truncate(left, room)
+	} else if stringWidth(left) >= room {
+		// keep a space between the two
+		left = truncate(left, room-1)
+	}
+
+	padding := room - stringWidth(left)
+	if padding < 0 {
+		padding = 0
+	}
+	return left + strings.Repeat(" ", padding) + right
+}
+
+// StatusMessage shows a message on the status line of the editor
+func (e *EditorConfig) StatusMessage(format string, arg ...interface{}) {
+	e.statusMessage = fmt.Sprintf(format, arg...)
+	e.statusMessageAt = time.Now()
+}
+
+// StatusMessageExpired reports whether the status message has been shown long enough,
+// a prompt stays until it is answered
+func (e *EditorConfig) StatusMessageExpired() bool {
+	return !e.prompting && time.Since(e.statusMessageAt) >= StatusMessageTime
+}
+
+func (e *EditorConfig) DrawStatusMessage() {
+	e.writeBuf.WriteString(CleanLine)
+	if !e.StatusMessageExpired() {
+		e.writeBuf.WriteString(truncate(e.statusMessage, e.screenCols))
+	}
+}
+
+func (e *EditorConfig) WindowTooSmall() bool {
+	return e.TextRows()+2 < MinWindowRows || e.screenCols < MinWindowCols
+}
+
+// DrawTooSmall replaces the whole screen with a notice until the window grows
+func (e *EditorConfig) DrawTooSmall() {
+	e.screenLines = nil
+	e.writeBuf.WriteString(CursorHide)
+	e.writeBuf.WriteString(CursorReposition)
+
+	message := fmt.Sprintf("terminal too small (need at least %d×%d)", MinWindowCols, MinWindowRows)
+	message = truncate(message, e.screenCols)
+	rows := e.TextRows() + 2
+	for y := 0; y < rows; y++ {
+		e.writeBuf.WriteString(CleanLine)
+		if y == (rows-1)/2 {
+			if padding := (e.screenCols - stringWidth(message)) / 2; padding > 0 {
+				e.writeBuf.WriteString(strings.Repeat(" ", padding))
 			}
-			last := buffer.String()[:buffer.Len()-1]
-			buffer = strings.Builder{}
-			buffer.WriteString(last)
-		} else if char == EscapeChar {
-			StatusMessage("")
-			if callback != nil {
-				callback(buffer.String(), char)
+			e.writeBuf.WriteString(message)
+		}
+		if y < rows-1 {
+			e.writeBuf.WriteString(NewLine)
+		}
+	}
+	e.writeBuf.Flush()
+}
+
+func (e *EditorConfig) RefreshScreen() {
+	e.writeBuf.Reset(e.out)
+	if e.WindowTooSmall() {
+		e.DrawTooSmall()
+		return
+	}
+
+	if e.hexMode {
+		e.HexScroll()
+	} else {
+		e.Scroll()
+		e.HighlightTo(e.offRow + e.screenRows)
+		if e.split {
+			e.HighlightTo(e.otherPane.offRow + e.otherPane.screenRows)
+		}
+		e.HighlightBracket()
+	}
+
+	// draw the screen aside, to send only the lines that changed
+	e.frame.Reset()
+	e.writeBuf.Reset(&e.frame)
+	if e.overlay != nil {
+		e.DrawOverlay()
+	} else if e.hexMode {
+		e.DrawHexRows()
+	} else if e.split {
+		e.DrawPanes()
+	} else {
+		e.DrawRows()
+	}
+	e.DrawStatusBar()
+	e.DrawStatusMessage()
+	e.writeBuf.Flush()
+	e.writeBuf.Reset(e.out)
+
+	e.writeBuf.WriteString(CursorHide)
+	e.DrawChangedLines(strings.Split(e.frame.String(), NewLine))
+
+	paneTop := 0
+	if e.split && e.pane == 1 {
+		paneTop = e.otherPane.screenRows + 1
+	}
+	cursorY, cursorX := e.y-e.offRow, e.renderX-e.offCol
+	if e.softWrap && !e.hexMode {
+		cursorY, cursorX = e.WrapCursor()
+	}
+	e.writeBuf.WriteString(move(paneTop+cursorY+1, e.TextLeft()+cursorX+1))
+	e.writeBuf.WriteString(CursorShow)
+	e.writeBuf.Flush()
+}
+
+// DrawChangedLines draws the lines of the screen that are not already
+// on the terminal, each from a clean line and colors
+func (e *EditorConfig) DrawChangedLines(lines []string) {
+	if len(lines) != len(e.screenLines) {
+		e.screenLines = nil
+	}
+	for i, line := range lines {
+		if e.screenLines != nil && e.screenLines[i] == line {
+			continue
+		}
+		e.writeBuf.WriteString(move(i+1, 1))
+		e.writeBuf.WriteString(ColorBack)
+		e.writeBuf.WriteString(CleanLine)
+		e.writeBuf.WriteString(line)
+	}
+	e.writeBuf.WriteString(ColorBack)
+	e.screenLines = lines
+}
+
+func (e *EditorConfig) InsertNewLine() {
+	if !e.CheckWritable() {
+		return
+	}
+	if e.y == len(e.rows) {
+		// an empty buffer still has the line the cursor is on to break
+		e.InsertRow(len(e.rows), "")
+	}
+	if e.x == 0 {
+		e.InsertRow(e.y, "")
+	} else {
+		line := e.rows[e.y].line
+		e.InsertRow(e.y+1, line[e.x:])
+		e.RecordChange(e.y, []string{line}, []string{line[:e.x]})
+		e.rows[e.y].line = line[:e.x]
+		e.RenderRow(&e.rows[e.y])
+	}
+
+	e.y++
+	e.x = 0
+}
+
+func (e *EditorConfig) InsertChar(char rune) {
+	if !e.CheckWritable() {
+		return
+	}
+	if e.y == len(e.rows) {
+		e.InsertRow(len(e.rows), "")
+	}
+	line := e.rows[e.y].line
+	e.RowInsertChar(&e.rows[e.y], e.x, char)
+	e.RecordChange(e.y, []string{line}, []string{e.rows[e.y].line})
+	e.x += utf8.RuneLen(char)
+}
+
+func (e *EditorConfig) InsertString(str string) {
+	if !e.CheckWritable() {
+		return
+	}
+	if e.y == len(e.rows) {
+		e.InsertRow(len(e.rows), "")
+	}
+	line := e.rows[e.y].line
+	e.RowInsertString(&e.rows[e.y], e.x, str)
+	e.RecordChange(e.y, []string{line}, []string{e.rows[e.y].line})
+	e.x += len(str)
+}
+
+func (e *EditorConfig) InsertTab() {
+	switch e.tabMode {
+	case TabModeSpaces:
+		e.InsertString(strings.Repeat(" ", e.tabWidth))
+	case TabModeStop:
+		renderX := 0
+		if row, ok := e.GetCurRow(); ok {
+			renderX = e.X2Render(row, e.x)
+		}
+		e.InsertString(strings.Repeat(" ", e.tabWidth-renderX%e.tabWidth))
+	default:
+		e.InsertChar('\t')
+	}
+}
+
+// IndentSelection indents or dedents the lines of the selection,
+// and reports whether there was one
+func (e *EditorConfig) IndentSelection(dedent bool) bool {
+	_, fromY, toX, toY, ok := e.Selection()
+	if !ok {
+		return false
+	}
+	if toY > fromY && toX == 0 && !e.blockSelect {
+		// nothing of the last line is selected
+		toY--
+	}
+	e.IndentRows(fromY, toY, dedent)
+	return true
+}
+
+// IndentRows adds one level of indentation to the rows from to to,
+// or removes up to one level, the cursor and selection stay on the same text
+func (e *EditorConfig) IndentRows(from, to int, dedent bool) {
+	if !e.CheckWritable() || to >= len(e.rows) {
+		return
+	}
+	unit := "\t"
+	if e.tabMode != TabModeLiteral {
+		unit = strings.Repeat(" ", e.tabWidth)
+	}
+
+	shift := func(x, delta int) int {
+		if x += delta; x < 0 {
+			return 0
+		}
+		return x
+	}
+	for y := from; y <= to; y++ {
+		line := e.rows[y].line
+		delta := len(unit)
+		if dedent {
+			delta = -e.dedentWidth(line)
+		} else if line == "" {
+			// no whitespace alone on empty lines
+			continue
+		}
+
+		if delta > 0 {
+			e.SetLine(y, unit+line)
+		} else {
+			e.SetLine(y, line[-delta:])
+		}
+		if y == e.y {
+			e.x = shift(e.x, delta)
+		}
+		if e.selecting && y == e.selY {
+			e.selX = shift(e.selX, delta)
+		}
+	}
+}
+
+// dedentWidth is the number of bytes of one level of indentation at the start of line,
+// a tab or up to a tab width of spaces
+func (e *EditorConfig) dedentWidth(line string) int {
+	if strings.HasPrefix(line, "\t") {
+		return 1
+	}
+	n := 0
+	for n < len(line) && n < e.tabWidth && line[n] == ' ' {
+		n++
+	}
+	return n
+}
+
+// InsertCodePoint prompts for a code point like U+1F600 and inserts its character
+func (e *EditorConfig) InsertCodePoint() {
+	input, ok := e.Prompt("Insert code point: %s", nil)
+	if !ok || input == "" {
+		return
+	}
+
+	hex := strings.ToUpper(strings.TrimSpace(input))
+	hex = strings.TrimPrefix(hex, "U+")
+	hex = strings.TrimPrefix(hex, "0X")
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || !utf8.ValidRune(rune(value)) || unicode.IsControl(rune(value)) {
+		e.StatusMessage("Invalid code point %s", input)
+		return
+	}
+
+	e.InsertString(string(rune(value)))
+}
+
+func (e *EditorConfig) DeleteChar() {
+	if !e.CheckWritable() {
+		return
+	}
+	if e.y >= len(e.rows) || e.x == 0 && e.y == 0 {
+		return
+	}
+
+	row := &e.rows[e.y]
+	if e.x > 0 {
+		line := row.line
+		_, size := utf8.DecodeLastRuneInString(line[:e.x])
+		e.RowDeleteChar(row, e.x-size)
+		e.RecordChange(e.y, []string{line}, []string{row.line})
+		e.x -= size
+	} else {
+		upRow := &e.rows[e.y-1]
+		line := upRow.line
+		e.RowAppendString(upRow, row.line)
+		e.RecordChange(e.y-1, []string{line}, []string{upRow.line})
+		e.x = len(line)
+		e.DeleteRow(e.y)
+		e.y--
+	}
+}
+
+/* macros */
+
+func (e *EditorConfig) StartMacro() {
+	if e.replaying {
+		return
+	}
+	e.recording = true
+	e.macro = nil
+	e.StatusMessage("Recording macro, press Alt-) to stop")
+}
+
+func (e *EditorConfig) StopMacro() {
+	if !e.recording {
+		return
+	}
+	e.recording = false
+	// without the keys stopping it, like the command palette and its prompt
+	e.macro = e.macro[:e.macroKeyStart]
+	e.StatusMessage("Recorded macro of %d keys, press Alt-x to replay it", len(e.macro))
+}
+
+// ReplayMacro feeds the recorded keys to ProcessKeyPress as many times as asked,
+// stopping early when a key fails like a search not found or a move past the end of the buffer
+func (e *EditorConfig) ReplayMacro() {
+	if e.replaying {
+		return
+	}
+	if e.recording {
+		e.macro = e.macro[:e.macroKeyStart]
+		e.StatusMessage("Stop recording the macro first, with Alt-)")
+		return
+	}
+	if len(e.macro) == 0 {
+		e.StatusMessage("No macro recorded, press Alt-( to start")
+		return
+	}
+
+	input, ok := e.Prompt("Replay macro times: %s (ESC to cancel, Enter for once)", nil)
+	if !ok {
+		return
+	}
+	times := 1
+	if input != "" {
+		n, err := strconv.Atoi(input)
+		if err != nil || n < 1 {
+			e.StatusMessage("Invalid number of times %s", input)
+			return
+		}
+		times = n
+	}
+
+	e.replaying = true
+	defer func() {
+		e.replaying = false
+		e.pendingKeys = nil
+	}()
+	for i := 0; i < times; i++ {
+		e.pendingKeys = append([]rune(nil), e.macro...)
+		for len(e.pendingKeys) > 0 {
+			e.macroStop = false
+			e.ProcessKeyPress()
+			if e.macroStop {
+				e.StatusMessage("Macro stopped after %d of %d times", i, times)
+				return
 			}
-			return "", false
-		} else if !unicode.IsControl(char) && char < 128 {
-			buffer.WriteRune(char)
 		}
-		if callback != nil {
-			callback(buffer.String(), char)
+	}
+	e.StatusMessage("Replayed macro %d times", times)
+}
+
+/* pairs */
+
+var pairs = map[rune]rune{'(': ')', '[': ']', '{': '}', '"': '"', '\'': '\''}
+
+// InsertPair types char with its closing pair in auto-pairing mode,
+// or steps over char when it is the closing one already after the cursor
+func (e *EditorConfig) InsertPair(char rune) bool {
+	if !e.autoPair || !e.CheckWritable() {
+		return false
+	}
+	line := ""
+	if row, ok := e.GetCurRow(); ok {
+		line = row.line
+	}
+	next, _ := utf8.DecodeRuneInString(line[e.x:])
+	prev, _ := utf8.DecodeLastRuneInString(line[:e.x])
+
+	if next == char && isCloser(char) {
+		e.x++
+		return true
+	}
+	closer, ok := pairs[char]
+	if !ok {
+		return false
+	}
+	// only before the end of the text, and quotes not right after a word like in don't
+	if e.x < len(line) && !unicode.IsSpace(next) && !isCloser(next) {
+		return false
+	}
+	if closer == char && e.x > 0 && (!isSeparator(prev) || prev == char) {
+		return false
+	}
+
+	e.InsertString(string(char) + string(closer))
+	e.x--
+	e.pairOpen = true
+	return true
+}
+
+// DeletePair deletes both characters of the pair around the cursor
+func (e *EditorConfig) DeletePair() bool {
+	row, ok := e.GetCurRow()
+	if !ok || e.x == 0 || e.x >= len(row.line) {
+		return false
+	}
+	if closer, ok := pairs[rune(row.line[e.x-1])]; !ok || rune(row.line[e.x]) != closer {
+		return false
+	}
+	e.ReplaceRows(e.y, e.y+1, []string{row.line[:e.x-1] + row.line[e.x+1:]})
+	e.x--
+	return true
+}
+
+func isCloser(char rune) bool {
+	for _, closer := range pairs {
+		if char == closer {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteWord deletes back to the start of the word before the cursor,
+// joining with the line above at the start of a line
+func (e *EditorConfig) DeleteWord() {
+	if !e.CheckWritable() {
+		return
+	}
+	row, ok := e.GetCurRow()
+	if !ok || e.x == 0 {
+		e.DeleteChar()
+		return
+	}
+
+	start := wordStart(row.line, e.x)
+	e.ReplaceRows(e.y, e.y+1, []string{row.line[:start] + row.line[e.x:]})
+	e.x = start
+}
+
+// DuplicateLine inserts a copy of the cursor line below it, and moves onto the copy
+func (e *EditorConfig) DuplicateLine() {
+	if !e.CheckWritable() {
+		return
+	}
+	row, ok := e.GetCurRow()
+	if !ok {
+		return
+	}
+
+	e.InsertRow(e.y+1, row.line)
+	e.y++
+}
+
+// MoveLine swaps the cursor line with the one above or below, the cursor follows it
+func (e *EditorConfig) MoveLine(delta int) {
+	if !e.CheckWritable() {
+		return
+	}
+	other := e.y + delta
+	if e.y >= len(e.rows) || other < 0 || other >= len(e.rows) {
+		return
+	}
+
+	first := e.y
+	if other < first {
+		first = other
+	}
+	e.ReplaceRows(first, first+2, []string{e.rows[first+1].line, e.rows[first].line})
+	e.y = other
+}
+
+func (e *EditorConfig) ProcessKeyPress() {
+	e.macroKeyStart = len(e.macro)
+	c := e.ReadKey()
+	e.StatusMessage(string(c))
+
+	if e.hexMode && e.HexProcessKey(c) {
+		return
+	}
+
+	if _, bound := editorFindAction(c); !bound && c >= altKey('0') && c <= altKey('9') {
+		e.repeatCount = e.repeatCount*10 + int(c-altKey('0'))
+		e.StatusMessage("Repeat %d times", e.repeatCount)
+		return
+	}
+	if n := e.repeatCount; n > 0 {
+		e.repeatCount = 0
+		e.RepeatKey(c, n)
+		return
+	}
+
+	e.UndoBegin()
+	defer e.UndoEnd()
+
+	pairOpen := e.pairOpen
+	e.pairOpen = false
+
+	// moving with Shift selects, any other key ends the selection once done
+	shifted := false
+	if key, ok := unshiftKey(c); ok && !e.hexMode {
+		if !e.selecting {
+			e.selecting = true
+			e.selX, e.selY = e.x, e.y
+		}
+		c, shifted = key, true
+	}
+	// editing a block selection keeps it, to go on typing into every line
+	keep := false
+	defer func() {
+		if !shifted && !keep {
+			e.selecting = false
+		}
+	}()
+
+	lastQuitTimes := e.quitTimes
+	defer func() {
+		// only pressing quit again keeps counting down
+		if e.quitTimes == lastQuitTimes {
+			e.quitTimes = e.quitConfirm
+		}
+	}()
+
+	if action, ok := editorFindAction(c); ok {
+		action.run(e)
+		return
+	}
+
+	switch c {
+	case Enter:
+		e.DeleteSelection()
+		e.InsertNewLine()
+
+	case PageUp, PageDown:
+		e.PushJump()
+		if e.softWrap {
+			// from the first or last line on the screen
+			edge := 0
+			if c == PageDown {
+				edge = e.screenRows - 1
+			}
+			at, render := e.WrapPosition(edge, 0)
+			e.y = at
+			if e.y < 0 {
+				e.y = 0
+			}
+			if e.y > e.LastRow() {
+				e.y = e.LastRow()
+			}
+			if row, ok := e.GetCurRow(); ok {
+				e.x = e.Render2X(row, render)
+			}
+		} else if c == PageUp {
+			e.y = e.offRow
+			if e.y < 0 {
+				e.y = 0
+			}
+		} else {
+			e.y = e.offRow + e.screenRows - 1
+			if e.y > e.LastRow() {
+				e.y = e.LastRow()
+			}
+		}
+
+		for times := e.screenRows; times > 0; times-- {
+			if c == PageUp {
+				e.MoveCursor(ArrowUp)
+			} else {
+				e.MoveCursor(ArrowDown)
+			}
+		}
+	case HomeKey:
+		// to the first character of the text, then to the start of the line
+		indent := 0
+		if row, ok := e.GetCurRow(); ok {
+			indent = len(row.line) - len(strings.TrimLeft(row.line, " \t"))
+		}
+		if e.x == indent {
+			e.x = 0
+		} else {
+			e.x = indent
+		}
+	case EndKey:
+		if e.y < len(e.rows) {
+			e.x = len(e.rows[e.y].line)
+		}
+	case DelKey:
+		if keep = e.DeleteBlock(); keep {
+			break
+		}
+		if e.DeleteSelection() {
+			break
+		}
+		e.MoveCursor(ArrowRight)
+		fallthrough
+	case Backspace, ctrlKey('h'):
+		if keep = e.BlockBackspace(); keep {
+			break
+		}
+		if e.DeleteSelection() {
+			break
+		}
+		if pairOpen && e.DeletePair() {
+			break
+		}
+		e.DeleteChar()
+	case ArrowUp, ArrowDown, ArrowRight, ArrowLeft, CtrlArrowLeft, CtrlArrowRight:
+		e.MoveCursor(c)
+	case MouseEvent:
+		e.Mouse()
+	case '\t':
+		if keep = e.IndentSelection(false); !keep {
+			e.InsertTab()
+		}
+	case ShiftTab:
+		if keep = e.IndentSelection(true); !keep {
+			e.IndentRows(e.y, e.y, true)
+		}
+	case ctrlKey('l'), EscapeChar:
+
+	default:
+		if c >= AltModifier {
+			break
+		}
+		if keep = e.BlockInsert(c); !keep {
+			e.DeleteSelection()
+			if !e.InsertPair(c) {
+				e.InsertChar(c)
+			}
 		}
 	}
 }
 
-func editorInsertRow(at int, line string) {
-	source := E.rows
-	if at < 0 || at > len(source) {
-		return
-	}
-
-	dist := make([]EditorRow, len(source)+1)
-
-	var current EditorRow
-	for i := 0; i < len(dist); i++ {
-		if i < at {
-			current = source[i]
-		} else if i > at {
-			current = source[i-1]
-		} else {
-			current = EditorRow{line: line}
-		}
-		current.idx = i
-		dist[i] = current
+// RepeatKey processes key n times, stopping early like a macro when it fails
+func (e *EditorConfig) RepeatKey(key rune, n int) {
+	defer func() { e.repeated = 0 }()
+	e.macroStop = false
+	for e.repeated = 0; e.repeated < n && !e.macroStop; e.repeated++ {
+		e.pendingKeys = append([]rune{key}, e.pendingKeys...)
+		e.ProcessKeyPress()
 	}
-
-	editorRenderRow(&dist[at])
-
-	E.rows = dist
-	E.dirty = true
 }
 
-func editorDeleteRow(at int) {
-	source := E.rows
-	if at < 0 || at > len(source) {
+func (e *EditorConfig) Quit() {
+	if e.AnyDirty() && e.quitTimes > 0 {
+		e.StatusMessage("WARNING!! File has unsaved changes. Press Ctrl-q %d more times to quit", e.quitTimes)
+		e.quitTimes--
 		return
 	}
-
-	dist := make([]EditorRow, at)
-	copy(dist, source[:at])
-
-	if at < len(source)-1 {
-		dist = append(dist, source[at+1:]...)
+	e.StoreBuffer()
+	for _, b := range e.buffers {
+		e.RemoveSwapFile(b.filename)
 	}
-
-	for j := at; j < len(E.rows)-1; j++ {
-		E.rows[j].idx--
+	if e.once && e.dirty {
+		// tell the caller the edit was abandoned
+		e.exit(1)
 	}
-	E.rows = dist
-	E.dirty = true
+	e.exit(0)
 }
 
-func editorRowAppendString(row *EditorRow, line string) {
-	row.line = row.line + line
-	editorRenderRow(row)
-
-	E.dirty = true
+func (e *EditorConfig) ToggleReadOnly() {
+	e.readOnly = !e.readOnly
+	if e.readOnly {
+		e.StatusMessage("Read-only")
+	} else {
+		e.StatusMessage("Editing allowed")
+	}
 }
 
-func editorRowDeleteChar(row *EditorRow, at int) {
-	if at < 0 || at >= len(row.line) {
-		return
+func (e *EditorConfig) ToggleWrap() {
+	e.softWrap = !e.softWrap
+	e.offCol, e.offWrap = 0, 0
+	if e.softWrap {
+		e.StatusMessage("Soft wrap on")
+	} else {
+		e.StatusMessage("Soft wrap off")
 	}
+}
 
-	var builder strings.Builder
-	builder.WriteString(row.line[:at])
-	if at < len(row.line)-1 {
-		builder.WriteString(row.line[at+1:])
+func (e *EditorConfig) ToggleAutoPair() {
+	e.autoPair = !e.autoPair
+	if e.autoPair {
+		e.StatusMessage("Auto-pairing on")
+	} else {
+		e.StatusMessage("Auto-pairing off")
 	}
-
-	row.line = builder.String()
-	editorRenderRow(row)
-	E.dirty = true
 }
 
-func editorRowInsertChar(row *EditorRow, at int, char rune) {
-	if at < 0 || at > len(row.line) {
-		at = len(row.line)
+func (e *EditorConfig) ToggleTypewriter() {
+	e.typewriter = !e.typewriter
+	if e.typewriter {
+		e.StatusMessage("Typewriter mode on")
+	} else {
+		e.StatusMessage("Typewriter mode off")
 	}
+}
 
-	var builder strings.Builder
-	builder.Write([]byte(row.line[:at]))
-
-	builder.WriteByte(byte(char))
-
-	if at < len(row.line) {
-		builder.Write([]byte(row.line[at:]))
-	}
-	row.line = builder.String()
+/* actions */
 
-	editorRenderRow(row)
-	E.dirty = true
-}
+// NoKey is the key of an action the keys file left without one
+const NoKey rune = -1
 
-func editorDrawRows() {
-	for y := 0; y < E.screenRows; y++ {
-		writeBuf.WriteString(CleanLine)
+var actions []EditorAction
 
-		rowIndex := y + E.offRow
-		if rowIndex < len(E.rows) {
-			row := E.rows[rowIndex].render
-			l := len(row) - E.offCol
-			if l < 0 {
-				l = 0
-			}
-			if l > 0 {
-				if l > E.screenCols {
-					l = E.screenCols
-				}
-				row = row[E.offCol : E.offCol+l]
-
-				highlight := E.rows[rowIndex].highlight[E.offCol : E.offCol+l]
-				currentColor := -1
-				for i, char := range row {
-					if unicode.IsControl(char) {
-						var symbol rune
-						if char <= 26 {
-							symbol = '@'
-						} else {
-							symbol = '?'
-						}
-						writeBuf.WriteString(ColorInverted)
-						writeBuf.WriteByte(byte(symbol))
-						writeBuf.WriteString(ColorBack)
-						if currentColor != -1 {
-							colorText := fmt.Sprintf("%c[%dm", EscapeChar, currentColor)
-							writeBuf.WriteString(colorText)
-						}
-						continue
-					}
-					if highlight[i] == HighlightNormal {
-						if currentColor != -1 {
-							writeBuf.WriteString(TextColorDefault)
-							currentColor = -1
-						}
-					} else {
-						color := editorSyntaxToColor(highlight[i])
-						if color != currentColor {
-							currentColor = color
-							colorText := fmt.Sprintf("%c[%dm", EscapeChar, currentColor)
-							writeBuf.WriteString(colorText)
-						}
-					}
-					writeBuf.WriteByte(byte(char))
-				}
-				writeBuf.WriteString(TextColorDefault)
+func defaultActions() []EditorAction {
+	return []EditorAction{
+		{name: "Quit", key: ctrlKey('q'), run: (*EditorConfig).Quit},
+		{name: "Save", key: ctrlKey('s'), run: func(e *EditorConfig) {
+			e.Save()
+			if e.once && !e.dirty {
+				e.exit(0)
 			}
-		} else {
-			if len(E.rows) == 0 && y == E.screenRows/3 {
-				editorDrawWelcome()
-			} else {
-				writeBuf.WriteString(Tilde)
-			}
-		}
-		writeBuf.WriteString(NewLine)
+		}},
+		{name: "Find", key: ctrlKey('f'), run: (*EditorConfig).Find},
+		{name: "Replace", key: ctrlKey('r'), run: (*EditorConfig).Replace},
+		{name: "Go to line", key: ctrlKey('g'), run: (*EditorConfig).Goto},
+		{name: "Reload from disk", key: ctrlKey('e'), run: (*EditorConfig).Reload},
+		{name: "Jump to matching bracket", key: altKey('m'), run: (*EditorConfig).JumpToBracket},
+		{name: "Copy line", key: ctrlKey('c'), run: (*EditorConfig).CopyLine},
+		{name: "Cut line", key: ctrlKey('k'), run: (*EditorConfig).CutLine},
+		{name: "Paste", key: ctrlKey('u'), run: (*EditorConfig).Paste},
+		{name: "Toggle block selection", key: altKey('b'), run: (*EditorConfig).ToggleBlockSelect},
+		{name: "Duplicate line", key: ctrlKey('d'), run: (*EditorConfig).DuplicateLine},
+		{name: "Delete word", key: ctrlKey('w'), run: (*EditorConfig).DeleteWord},
+		{name: "Move line up", key: AltArrowUp, run: func(e *EditorConfig) { e.MoveLine(-1) }},
+		{name: "Move line down", key: AltArrowDown, run: func(e *EditorConfig) { e.MoveLine(1) }},
+		{name: "Find backward", key: ctrlKey('b'), run: (*EditorConfig).FindBackward},
+		{name: "Find next", key: altKey('n'), run: func(e *EditorConfig) { e.FindNext(false) }},
+		{name: "Find previous", key: altKey('N'), run: func(e *EditorConfig) { e.FindNext(true) }},
+		{name: "Undo", key: ctrlKey('z'), run: (*EditorConfig).Undo},
+		{name: "Redo", key: ctrlKey('y'), run: (*EditorConfig).Redo},
+		{name: "Command palette", key: ctrlKey('p'), run: (*EditorConfig).CommandPalette},
+		{name: "Jump back", key: altKey('o'), run: (*EditorConfig).JumpBack},
+		{name: "Jump forward", key: altKey('i'), run: (*EditorConfig).JumpForward},
+		{name: "Open file in new buffer", key: altKey('e'), run: (*EditorConfig).OpenBuffer},
+		{name: "Find file", key: ctrlKey('t'), run: (*EditorConfig).FindFile},
+		{name: "Next buffer", key: altKey('.'), run: func(e *EditorConfig) { e.NextBuffer(1) }},
+		{name: "Previous buffer", key: altKey(','), run: func(e *EditorConfig) { e.NextBuffer(-1) }},
+		{name: "Close buffer", key: altKey('w'), run: (*EditorConfig).CloseBuffer},
+		{name: "Toggle split", key: altKey('s'), run: (*EditorConfig).ToggleSplit},
+		{name: "Switch pane", key: altKey('p'), run: (*EditorConfig).SwitchPane},
+		{name: "Narrow to lines", key: altKey('r'), run: (*EditorConfig).Narrow},
+		{name: "Widen", key: altKey('R'), run: (*EditorConfig).Widen},
+		{name: "Reflow paragraph", key: altKey('q'), run: (*EditorConfig).Reflow},
+		{name: "Filter through command", key: altKey('|'), run: (*EditorConfig).Filter},
+		{name: "Indent with spaces", key: altKey('S'), run: func(e *EditorConfig) { e.Retab(false) }},
+		{name: "Indent with tabs", key: altKey('T'), run: func(e *EditorConfig) { e.Retab(true) }},
+		{name: "Insert code point", key: altKey('u'), run: (*EditorConfig).InsertCodePoint},
+		{name: "Lint buffer", key: altKey('k'), run: (*EditorConfig).Lint},
+		{name: "Next lint issue", key: altKey('K'), run: (*EditorConfig).NextLintIssue},
+		{name: "Start recording macro", key: altKey('('), run: (*EditorConfig).StartMacro},
+		{name: "Stop recording macro", key: altKey(')'), run: (*EditorConfig).StopMacro},
+		{name: "Replay macro", key: altKey('x'), run: (*EditorConfig).ReplayMacro},
+		{name: "Toggle typewriter mode", key: altKey('t'), run: (*EditorConfig).ToggleTypewriter},
+		{name: "Toggle soft wrap", key: altKey('z'), run: (*EditorConfig).ToggleWrap},
+		{name: "Toggle auto-pairing", key: altKey('a'), run: (*EditorConfig).ToggleAutoPair},
+		{name: "Toggle line numbers", key: ctrlKey('n'), run: (*EditorConfig).ToggleLineNumbers},
+		{name: "Toggle whitespace", key: altKey('v'), run: (*EditorConfig).ToggleWhitespace},
+		{name: "Toggle highlighting", key: altKey('h'), run: (*EditorConfig).ToggleHighlight},
+		{name: "Toggle centered column", key: altKey('c'), run: (*EditorConfig).ToggleCentered},
+		{name: "Toggle follow", key: altKey('f'), run: (*EditorConfig).ToggleFollow},
+		{name: "Load file fully", key: altKey('l'), run: (*EditorConfig).LoadFully},
+		{name: "Toggle read-only", key: altKey('L'), run: (*EditorConfig).ToggleReadOnly},
 	}
 }
 
-func editorDrawWelcome() {
-	welcome := fmt.Sprintf("gim editor -- version %s", GimVersion)
-	if len(welcome) > E.screenCols {
-		welcome = welcome[:E.screenCols]
-	}
-	padding := (E.screenCols - len(welcome)) / 2
-	if padding > 0 {
-		writeBuf.WriteString(Tilde)
-	}
-	for ; padding > 0; padding-- {
-		writeBuf.WriteString(" ")
+func defaultKeysFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
 	}
-
-	writeBuf.WriteString(welcome)
+	return filepath.Join(home, ".gim", "keys.json")
 }
 
-func editorDrawStatusBar() {
-	writeBuf.WriteString(ColorInverted)
-
-	var builder strings.Builder
-	builder.WriteString(E.filename)
-	builder.WriteString(" - ")
-	builder.WriteString(strconv.Itoa(len(E.rows)))
-	builder.WriteString(" lines")
-	if E.dirty {
-		builder.WriteString(" (modified)")
+// loadKeysFile binds the keys of filename to the actions named for them, like
+// {"Ctrl-W": "Save", "Ctrl-S": ""}, an empty name leaves the key to be typed,
+// a missing file is not an error, a malformed one binds none of them
+func loadKeysFile(filename string) error {
+	if filename == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
 	}
 
-	leftStatus := builder.String()
-	writeBuf.WriteString(leftStatus)
-
-	builder.Reset()
-	builder.WriteString(strconv.Itoa(E.y + 1))
-	builder.WriteByte(byte('/'))
-	builder.WriteString(strconv.Itoa(len(E.rows)))
-
-	builder.WriteByte(byte(' '))
-	if E.syntax != nil {
-		builder.WriteString(E.syntax.fileType)
-	} else {
-		builder.WriteString("no ft")
+	var bindings map[string]string
+	if err := json.Unmarshal(data, &bindings); err != nil {
+		return err
 	}
 
-	rightStatus := builder.String()
+	// in order, for the same error every time
+	names := make([]string, 0, len(bindings))
+	for name := range bindings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bound := append([]EditorAction(nil), actions...)
+	keyFor := make(map[string]string)
+	for _, name := range names {
+		actionName := bindings[name]
+		if other, ok := keyFor[strings.ToLower(actionName)]; ok && actionName != "" {
+			return fmt.Errorf("%s and %s are both bound to %q, a command has one key", other, name, actionName)
+		}
+		keyFor[strings.ToLower(actionName)] = name
 
-	// padding middle
-	for i := len(leftStatus); i < E.screenCols-len(rightStatus); i++ {
-		writeBuf.WriteString(" ")
+		key, ok := parseKeyName(name)
+		if !ok {
+			return fmt.Errorf("unknown key %q", name)
+		}
+		found := actionName == ""
+		for i := range bound {
+			if strings.EqualFold(bound[i].name, actionName) {
+				bound[i].key = key
+				found = true
+			} else if bound[i].key == key {
+				bound[i].key = NoKey
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown command %q for %s", actionName, name)
+		}
 	}
+	actions = bound
+	return nil
+}
 
-	writeBuf.WriteString(rightStatus)
-	writeBuf.WriteString(NewLine)
+// parseKeyName is the key named like keyName names it, like Ctrl-W, Alt-n or PageUp
+func parseKeyName(name string) (rune, bool) {
+	for key := rune(ArrowLeft); key <= ShiftTab; key++ {
+		if key != MouseEvent && keyName(key) == name {
+			return key, true
+		}
+	}
+	if name == keyName(Backspace) {
+		return Backspace, true
+	}
 
-	writeBuf.WriteString(ColorBack)
+	if len(name) == len("Ctrl-W") && strings.HasPrefix(name, "Ctrl-") {
+		char := unicode.ToUpper(rune(name[5]))
+		if char >= '@' && char <= '_' {
+			return ctrlKey(byte(char)), true
+		}
+		return 0, false
+	}
+	if strings.HasPrefix(name, "Alt-") && len(name) == len("Alt-n") && name[4] < utf8.RuneSelf {
+		return altKey(name[4]), true
+	}
+	if char, size := utf8.DecodeRuneInString(name); size > 0 && size == len(name) && !unicode.IsControl(char) {
+		return char, true
+	}
+	return 0, false
 }
 
-func StatusMessage(format string, arg ...interface{}) {
-	E.statusMessage = fmt.Sprintf(format, arg...)
-	go func() {
-		select {
-		case <-time.After(5 * time.Second):
-			E.statusMessage = ""
+func editorFindAction(key rune) (EditorAction, bool) {
+	for _, action := range actions {
+		if action.key == key {
+			return action, true
 		}
-	}()
+	}
+	return EditorAction{}, false
 }
 
-func editorDrawStatusMessage() {
-	writeBuf.WriteString(CleanLine)
-	l := len(E.statusMessage)
-
-	if l > E.screenCols {
-		l = E.screenCols
+// keyName describes key the way it is typed, like Ctrl-S or Alt-n
+func keyName(key rune) string {
+	switch {
+	case key == NoKey:
+		return ""
+	case key >= AltModifier:
+		return "Alt-" + string(key-AltModifier)
+	case key < 32:
+		return "Ctrl-" + string(key+'@')
 	}
 
-	if l > 0 {
-		writeBuf.WriteString(E.statusMessage[:l])
+	switch key {
+	case ArrowLeft:
+		return "Left"
+	case ArrowRight:
+		return "Right"
+	case ArrowUp:
+		return "Up"
+	case ArrowDown:
+		return "Down"
+	case HomeKey:
+		return "Home"
+	case EndKey:
+		return "End"
+	case DelKey:
+		return "Del"
+	case PageUp:
+		return "PageUp"
+	case PageDown:
+		return "PageDown"
+	case AltArrowUp:
+		return "Alt-Up"
+	case AltArrowDown:
+		return "Alt-Down"
+	case CtrlArrowLeft:
+		return "Ctrl-Left"
+	case CtrlArrowRight:
+		return "Ctrl-Right"
+	case ShiftLeft:
+		return "Shift-Left"
+	case ShiftRight:
+		return "Shift-Right"
+	case ShiftUp:
+		return "Shift-Up"
+	case ShiftDown:
+		return "Shift-Down"
+	case ShiftHome:
+		return "Shift-Home"
+	case ShiftEnd:
+		return "Shift-End"
+	case ShiftTab:
+		return "Shift-Tab"
+	case Backspace:
+		return "Backspace"
 	}
+	return string(key)
 }
 
-func editorRefreshScreen() {
-	editorScroll()
+/* palette */
 
-	writeBuf.WriteString(CursorHide)
-	writeBuf.WriteString(CursorReposition)
+// CommandPalette lists the actions matching what is typed and runs the chosen one
+func (e *EditorConfig) CommandPalette() {
+	e.paletteMatches = actions
+	e.overlaySelected = 0
+	e.PaletteUpdate()
 
-	editorDrawRows()
-	editorDrawStatusBar()
-	editorDrawStatusMessage()
+	_, ok := e.Prompt("Command: %s (Use ESC/Arrows/Enter)", e.PaletteCallback)
+	e.overlay = nil
+	if !ok || len(e.paletteMatches) == 0 {
+		return
+	}
 
-	writeBuf.WriteString(move(E.y-E.offRow+1, E.renderX-E.offCol+1))
-	writeBuf.WriteString(CursorShow)
-	writeBuf.Flush()
+	e.paletteMatches[e.overlaySelected].run(e)
 }
 
-func editorInsertNewLine() {
-	if E.x == 0 {
-		editorInsertRow(E.y, "")
-	} else {
-		line := E.rows[E.y].line
-		editorInsertRow(E.y+1, line[E.x:])
-		E.rows[E.y].line = line[:E.x]
-		editorRenderRow(&E.rows[E.y])
+func (e *EditorConfig) PaletteCallback(query string, key rune) {
+	switch key {
+	case ArrowUp:
+		if e.overlaySelected > 0 {
+			e.overlaySelected--
+		}
+		return
+	case ArrowDown:
+		if e.overlaySelected < len(e.paletteMatches)-1 {
+			e.overlaySelected++
+		}
+		return
+	case Enter, EscapeChar:
+		return
 	}
 
-	E.y++
-	E.x = 0
+	var names []string
+	for _, action := range actions {
+		names = append(names, action.name)
+	}
+	e.paletteMatches = nil
+	for _, i := range fuzzyFilter(names, query) {
+		e.paletteMatches = append(e.paletteMatches, actions[i])
+	}
+	e.overlaySelected = 0
+	e.PaletteUpdate()
 }
 
-func editorInsertChar(char rune) {
-	if E.y == len(E.rows) {
-		editorInsertRow(len(E.rows), "")
+func (e *EditorConfig) PaletteUpdate() {
+	e.overlay = nil
+	for _, action := range e.paletteMatches {
+		e.overlay = append(e.overlay, fmt.Sprintf("%-30s %s", action.name, keyName(action.key)))
 	}
-	editorRowInsertChar(&E.rows[E.y], E.x, char)
-	E.x++
 }
 
-func editorDeleteChar() {
-	if E.y == len(E.rows) {
-		editorDeleteRow(len(E.rows))
-		E.y--
-		return
-	}
-	if E.x == 0 && E.y == 0 {
-		return
+// fuzzyFilter returns the indexes of the candidates containing the letters
+// of query in order, best matches first
+func fuzzyFilter(candidates []string, query string) []int {
+	type match struct{ index, score int }
+	var matches []match
+
+	query = strings.ToLower(query)
+	for i, candidate := range candidates {
+		if score, ok := fuzzyScore(strings.ToLower(candidate), query); ok {
+			matches = append(matches, match{i, score})
+		}
 	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score < matches[j].score
+	})
 
-	row := &E.rows[E.y]
-	if E.x > 0 {
-		editorRowDeleteChar(row, E.x-1)
-		E.x--
-	} else {
-		upRow := &E.rows[E.y-1]
-		E.x = len(upRow.line)
-		editorRowAppendString(upRow, row.line)
-		editorDeleteRow(E.y)
-		E.y--
+	indexes := make([]int, len(matches))
+	for i, m := range matches {
+		indexes[i] = m.index
 	}
+	return indexes
 }
 
-var quitTimes = 3
-
-func editorProcessKeyPress() {
-	c := editorReadKey()
-	StatusMessage(string(c))
+// fuzzyScore counts the characters skipped to match query in candidate, the fewer the better
+func fuzzyScore(candidate, query string) (score int, ok bool) {
+	for _, char := range query {
+		i := strings.IndexRune(candidate, char)
+		if i == -1 {
+			return 0, false
+		}
+		score += i
+		candidate = candidate[i+utf8.RuneLen(char):]
+	}
+	return score, true
+}
 
-	switch c {
-	case Enter:
-		editorInsertNewLine()
+// DrawOverlay draws a list over the text, with the selected line inverted
+func (e *EditorConfig) DrawOverlay() {
+	rows := e.TextRows()
+	offset := 0
+	if e.overlaySelected >= rows {
+		offset = e.overlaySelected - rows + 1
+	}
 
-	case ctrlKey('q'):
-		if E.dirty && quitTimes > 0 {
-			StatusMessage("WARNING!! File has unsaved changes. Press Ctrl-q %d more times to quit", quitTimes)
-			quitTimes--
-			return
-		}
-		exit(0)
-	case ctrlKey('s'):
-		editorSave()
-	case ctrlKey('f'):
-		editorFind()
-	case PageUp, PageDown:
-		if c == PageUp {
-			E.y = E.offRow
-		} else {
-			E.y = E.offRow + E.screenRows - 1
-			if E.y > len(E.rows) {
-				E.y = len(E.rows)
+	for y := 0; y < rows; y++ {
+		e.writeBuf.WriteString(CleanLine)
+		if i := y + offset; i < len(e.overlay) {
+			if i == e.overlaySelected {
+				e.writeBuf.WriteString(ColorInverted)
 			}
-		}
-
-		for times := E.screenRows; times > 0; times-- {
-			if c == PageUp {
-				editorMoveCursor(ArrowUp)
-			} else {
-				editorMoveCursor(ArrowDown)
+			e.writeBuf.WriteString(truncate(e.overlay[i], e.screenCols))
+			if i == e.overlaySelected {
+				e.writeBuf.WriteString(ColorBack)
 			}
+		} else {
+			e.writeBuf.WriteString(Tilde)
 		}
-	case HomeKey:
-		E.x = 0
-	case EndKey:
-		if E.y < len(E.rows) {
-			E.x = len(E.rows[E.y].line)
-		}
-	case DelKey:
-		editorMoveCursor(ArrowRight)
-		fallthrough
-	case Backspace, ctrlKey('h'):
-		editorDeleteChar()
-	case ArrowUp, ArrowDown, ArrowRight, ArrowLeft:
-		editorMoveCursor(c)
-	case ctrlKey('l'), EscapeChar:
-
-	default:
-		editorInsertChar(c)
+		e.writeBuf.WriteString(NewLine)
 	}
-
-	quitTimes = 3
 }
 
-func readRune() rune {
+func (e *EditorConfig) readRune() rune {
 	var (
 		buffer [1]byte
 		size   int
@@ -1016,38 +6403,194 @@ func readRune() rune {
 	)
 
 	for size, err = os.Stdin.Read(buffer[:]); size != 1; {
+		e.Idle()
 		size, err = os.Stdin.Read(buffer[:])
 	}
 
-	maybe(err)
+	e.maybe(err)
 
 	return rune(buffer[0])
 }
 
-func editorReadKey() (char rune) {
-	char = readRune()
+// Idle runs every time reading a key times out
+func (e *EditorConfig) Idle() {
+	refresh := false
+	if e.following && e.Follow() {
+		refresh = true
+	}
+	if e.showBranch && time.Since(e.gitBranchAt) > GitBranchRefresh {
+		branch := e.gitBranch
+		e.RefreshGitBranch()
+		refresh = refresh || branch != e.gitBranch
+	}
+	select {
+	case <-resized:
+		e.UpdateWindowSize()
+		refresh = true
+	default:
+		if e.WindowTooSmall() {
+			// wait for the window to grow back
+			e.UpdateWindowSize()
+			refresh = !e.WindowTooSmall()
+		}
+	}
+	if e.finder.active && e.FinderUpdate() {
+		refresh = true
+	}
+	if e.AutoSave() {
+		refresh = true
+	}
+	if e.statusMessage != "" && e.StatusMessageExpired() {
+		// take the message off the screen
+		e.statusMessage = ""
+		refresh = true
+	}
+	if hint := e.IdleHint(); hint != e.idleHint {
+		e.idleHint = hint
+		refresh = true
+	}
+
+	if refresh {
+		e.RefreshScreen()
+	}
+}
+
+// AutoSave saves the buffer once the user has been idle for a while with
+// unsaved changes, it reports whether it wrote anything
+func (e *EditorConfig) AutoSave() bool {
+	if e.autoSaveAfter <= 0 || !e.dirty || e.prompting || e.Unnamed() ||
+		e.readOnly || e.partial || e.follow ||
+		time.Since(e.lastKeyAt) < e.autoSaveAfter || e.autoSavedAt.After(e.lastKeyAt) {
+		return false
+	}
+	e.autoSavedAt = time.Now()
+
+	if e.autoSaveSwap {
+		if _, err := e.WriteFile(editorSwapFile(e.filename)); err != nil {
+			e.StatusMessage("Can't auto-save! %s", err)
+		}
+		return true
+	}
+	if e.ChangedOnDisk() {
+		e.StatusMessage("Not auto-saved: file changed on disk")
+		return true
+	}
+	if err := e.Backup(e.filename); err != nil {
+		e.StatusMessage("Can't back up! %s", err)
+		return true
+	}
+	if _, err := e.WriteFile(e.filename); err != nil {
+		e.StatusMessage("Can't auto-save! %s", err)
+		return true
+	}
+	e.StatusMessage("Auto-saved")
+	e.StatFile()
+	e.dirty = false
+	return true
+}
+
+// editorSwapFile is where the auto-save of filename goes in swap mode
+func editorSwapFile(filename string) string {
+	return filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".swp")
+}
+
+// RemoveSwapFile deletes the auto-save of filename, once it is no longer needed
+func (e *EditorConfig) RemoveSwapFile(filename string) {
+	if e.autoSaveSwap {
+		os.Remove(editorSwapFile(filename))
+	}
+}
+
+// IdleHint is the indicator shown once the user has been idle
+// for a while with unsaved changes, it pulses every second
+func (e *EditorConfig) IdleHint() string {
+	if e.unsavedHintAfter <= 0 || !e.dirty {
+		return ""
+	}
+
+	idle := time.Since(e.lastKeyAt)
+	if idle < e.unsavedHintAfter || int(idle.Seconds())%2 == 1 {
+		return ""
+	}
+	return "unsaved"
+}
+
+// readUTF8 reads the rest of the character starting with the byte lead
+func (e *EditorConfig) readUTF8(lead byte) rune {
+	buffer := []byte{lead}
+	for !utf8.FullRune(buffer) {
+		buffer = append(buffer, byte(e.readRune()))
+	}
+
+	char, _ := utf8.DecodeRune(buffer)
+	return char
+}
+
+func (e *EditorConfig) ReadKey() (char rune) {
+	if len(e.pendingKeys) > 0 {
+		char, e.pendingKeys = e.pendingKeys[0], e.pendingKeys[1:]
+		return char
+	}
+	defer func() {
+		// the mouse report is gone once read, clicks are not replayed
+		if e.recording && char != MouseEvent {
+			e.macro = append(e.macro, char)
+		}
+	}()
+
+	char = e.readRune()
+	e.lastKeyAt = time.Now()
+	e.idleHint = ""
 
+	if char >= utf8.RuneSelf {
+		return e.readUTF8(byte(char))
+	}
 	if char != EscapeChar {
 		return
 	}
 
 	// <esc>[
-	return editorReadMoreKey()
+	return e.ReadMoreKey()
 }
 
-func editorReadMoreKey() rune {
+func (e *EditorConfig) ReadMoreKey() rune {
 	var buffer [2]byte
-	if size, _ := os.Stdin.Read(buffer[:]); size != 2 {
+	size, _ := os.Stdin.Read(buffer[:])
+	if size == 1 && buffer[0] != '[' && !unicode.IsControl(rune(buffer[0])) {
+		// <esc>{key} is sent for Alt-{key}
+		return altKey(buffer[0])
+	}
+	if size != 2 {
 		return EscapeChar
 	}
 
 	if buffer[0] == '[' {
+		if buffer[1] == '<' {
+			return e.ReadMouse()
+		}
 		if buffer[1] >= '0' && buffer[1] <= '9' {
 			var oneMoreByte [1]byte
 			if size, _ := os.Stdin.Read(oneMoreByte[:]); size != 1 {
 				return EscapeChar
 			}
 
+			if oneMoreByte[0] == ';' {
+				// <esc>[1;{modifier}{key}, 2 is Shift, 3 is Alt and 5 is Ctrl
+				var modified [2]byte
+				if size, _ := os.Stdin.Read(modified[:]); size != 2 {
+					return EscapeChar
+				}
+				switch modified[0] {
+				case '2':
+					return editorMapShiftKey(rune(modified[1]))
+				case '3':
+					return editorMapAltArrowKey(rune(modified[1]))
+				case '5':
+					return editorMapCtrlArrowKey(rune(modified[1]))
+				}
+				return EscapeChar
+			}
+
 			if oneMoreByte[0] == '~' {
 				switch buffer[1] {
 				case '1':
@@ -1075,8 +6618,17 @@ func editorReadMoreKey() rune {
 				return HomeKey
 			case 'F':
 				return EndKey
+			case 'Z':
+				return ShiftTab
 			}
 		}
+	} else if buffer[0] == EscapeChar && buffer[1] == '[' {
+		// terminals sending <esc> before a key for Alt
+		var oneMoreByte [1]byte
+		if size, _ := os.Stdin.Read(oneMoreByte[:]); size != 1 {
+			return EscapeChar
+		}
+		return editorMapAltArrowKey(rune(oneMoreByte[0]))
 	} else if buffer[0] == 'O' {
 		switch buffer[1] {
 		case 'H':
@@ -1091,11 +6643,11 @@ func editorReadMoreKey() rune {
 
 /* Terminal */
 
-func EnableRawMode() {
-	E.originTermios = tcGetAttr(syscall.Stdin)
+func (e *EditorConfig) EnableRawMode() {
+	e.originTermios = tcGetAttr(int(os.Stdin.Fd()))
 
 	var raw syscall.Termios
-	raw = *E.originTermios
+	raw = *e.originTermios
 	raw.Lflag &^= syscall.ECHO | // echo the input
 		syscall.ICANON | // disable canonical mode
 		syscall.ISIG | // disable C-C and C-Z
@@ -1114,66 +6666,63 @@ func EnableRawMode() {
 	raw.Cc[syscall.VMIN] = 0  // minimum number of bytes of input
 	raw.Cc[syscall.VTIME] = 1 // maximum amount of time to wait, current 1 / 10
 
-	tcSetAttr(syscall.Stdin, &raw)
+	tcSetAttr(int(os.Stdin.Fd()), &raw)
 }
 
-func DisableRawMode() {
-	tcSetAttr(syscall.Stdin, E.originTermios)
+// isTerminal reports whether file is a terminal rather than a pipe or a file
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
 
-func tcSetAttr(fd int, termios *syscall.Termios) {
-	_, _, errNo := syscall.Syscall(
-		syscall.SYS_IOCTL,
-		uintptr(fd),
-		syscall.TIOCSETAF,
-		uintptr(unsafe.Pointer(termios)),
-	)
+func (e *EditorConfig) DisableRawMode() {
+	if e.originTermios == nil {
+		// raw mode was never enabled
+		return
+	}
+	tcSetAttr(int(os.Stdin.Fd()), e.originTermios)
+}
 
-	if errNo != 0 {
+func tcSetAttr(fd int, termios *syscall.Termios) {
+	if errNo := setTermios(fd, termios); errNo != 0 {
 		log.Fatalf("Problem setting termial attributes: %s\n", errNo)
 	}
 }
 
 func tcGetAttr(fd int) *syscall.Termios {
 	termios := &syscall.Termios{}
-	_, _, errNo := syscall.Syscall(
-		syscall.SYS_IOCTL,
-		uintptr(fd),
-		syscall.TIOCGETA,
-		uintptr(unsafe.Pointer(termios)),
-	)
-
-	if errNo != 0 {
+	if errNo := getTermios(fd, termios); errNo != 0 {
 		log.Fatalf("Problem getting termial attributes: %s\n", errNo)
 	}
 
 	return termios
 }
 
-func ioctlGetWinSize(ws *WinSize) syscall.Errno {
-	_, _, errNo := syscall.Syscall(
-		syscall.SYS_IOCTL,
-		uintptr(syscall.Stdout),
-		syscall.TIOCGWINSZ,
-		uintptr(unsafe.Pointer(&ws)),
-	)
+func ioctl(fd int, request uintptr, arg unsafe.Pointer) syscall.Errno {
+	_, _, errNo := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(arg))
 	return errNo
 }
 
+func ioctlGetWinSize(ws *WinSize) syscall.Errno {
+	return ioctl(syscall.Stdout, syscall.TIOCGWINSZ, unsafe.Pointer(ws))
+}
+
 type WinSize struct {
-	Row uint16
-	Col uint16
+	Row    uint16
+	Col    uint16
+	Xpixel uint16
+	Ypixel uint16
 }
 
-func GetCursorPosition() (row int, col int) {
+func (e *EditorConfig) GetCursorPosition() (row int, col int) {
 	// will response <esc>[24;80R
-	exec(CursorPosition)
+	e.exec(CursorPosition)
 
 	var buf strings.Builder
 
 	var i int
 	for i < 32 {
-		c := readRune()
+		c := e.readRune()
 		buf.WriteRune(c)
 		if c == 'R' {
 			break
@@ -1186,7 +6735,7 @@ func GetCursorPosition() (row int, col int) {
 	return
 }
 
-func GetWindowSize() (int, int) {
+func (e *EditorConfig) GetWindowSize() (int, int) {
 	var ws WinSize
 	errNo := ioctlGetWinSize(&ws)
 
@@ -1194,61 +6743,203 @@ func GetWindowSize() (int, int) {
 		return int(ws.Row), int(ws.Col)
 	} else if errNo == 0 {
 		// move cursor to bottom-right corner, then get the position
-		exec(CursorForwardFaraway + CursorDownFaraway)
-		return GetCursorPosition()
+		e.exec(CursorForwardFaraway + CursorDownFaraway)
+		return e.GetCursorPosition()
+	} else if row, col, ok := getEnvWindowSize(); ok {
+		// no terminal to ask, trust what the environment says
+		return row, col
 	} else {
-		maybe(errors.New("getWindowSize"))
+		e.maybe(errors.New("can't get the size of the terminal"))
 		return 0, 0
 	}
 }
 
+// the smallest window the editor can draw in
+const (
+	MinWindowRows = 3 // 1 for text, 1 for status bar, 1 for status message
+	MinWindowCols = 20
+)
+
+// getEnvWindowSize reads the window size from the LINES and COLUMNS environment variables
+func getEnvWindowSize() (row int, col int, ok bool) {
+	row, errRow := strconv.Atoi(os.Getenv("LINES"))
+	col, errCol := strconv.Atoi(os.Getenv("COLUMNS"))
+	if errRow != nil || errCol != nil || row <= 0 || col <= 0 {
+		return 0, 0, false
+	}
+
+	if row < MinWindowRows {
+		row = MinWindowRows
+	}
+	if col < MinWindowCols {
+		col = MinWindowCols
+	}
+	return row, col, true
+}
+
 /* Utils */
 
-func Render2X(row *EditorRow, render int) int {
-	var curRender, x int
-	for ; x < len(row.line); x++ {
-		if row.line[x] == '\t' {
-			curRender += len(TabStop) - 1
+// Render2X is the byte of row.line drawn at the render column
+func (e *EditorConfig) Render2X(row *EditorRow, render int) int {
+	var curRender int
+	for x, char := range row.line {
+		if char == '\t' {
+			curRender += e.tabWidth - curRender%e.tabWidth
+		} else {
+			curRender += runeWidth(char)
 		}
-		curRender++
 
 		if curRender > render {
 			return x
 		}
 	}
+	return len(row.line)
+}
+
+// X2Render is the render column the byte x of row.line is drawn at
+func (e *EditorConfig) X2Render(row *EditorRow, x int) int {
+	return e.renderWidth(row.line[:x])
+}
+
+// renderOffset is the byte of row.render the byte x of row.line is drawn at
+func (e *EditorConfig) renderOffset(row *EditorRow, x int) int {
+	return renderIndex(row, e.X2Render(row, x))
+}
+
+// renderIndex is the byte of row.render drawn at the render column col
+func renderIndex(row *EditorRow, col int) int {
+	var width int
+	for i, char := range row.render {
+		if width >= col {
+			return i
+		}
+		width += runeWidth(char)
+	}
+	return len(row.render)
+}
+
+// runeStart moves x back to the start of the character it is in
+func runeStart(s string, x int) int {
+	for x > 0 && x < len(s) && !utf8.RuneStart(s[x]) {
+		x--
+	}
 	return x
 }
-func X2Render(row *EditorRow, x int) int {
-	var render int
-	for j := 0; j < x; j++ {
-		if row.line[j] == '\t' {
-			render += len(TabStop) - 1
+
+// runeWidth is the number of columns char takes on screen,
+// two for wide East Asian characters and none for combining marks
+func runeWidth(char rune) int {
+	switch {
+	case unicode.IsControl(char):
+		// drawn as a single inverted symbol
+		return 1
+	case unicode.In(char, unicode.Mn, unicode.Me):
+		return 0
+	case unicode.Is(wideRunes, char):
+		return 2
+	}
+	return 1
+}
+
+// stringWidth is the number of columns s takes on screen, like renderWidth
+// for text that has no tabs to expand
+func stringWidth(s string) int {
+	var width int
+	for _, char := range s {
+		width += runeWidth(char)
+	}
+	return width
+}
+
+// wideRunes are the East Asian wide and fullwidth characters
+var wideRunes = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x1100, Hi: 0x115f, Stride: 1},
+		{Lo: 0x2e80, Hi: 0x303e, Stride: 1},
+		{Lo: 0x3041, Hi: 0x33ff, Stride: 1},
+		{Lo: 0x3400, Hi: 0x4dbf, Stride: 1},
+		{Lo: 0x4e00, Hi: 0x9fff, Stride: 1},
+		{Lo: 0xa000, Hi: 0xa4cf, Stride: 1},
+		{Lo: 0xac00, Hi: 0xd7a3, Stride: 1},
+		{Lo: 0xf900, Hi: 0xfaff, Stride: 1},
+		{Lo: 0xfe30, Hi: 0xfe4f, Stride: 1},
+		{Lo: 0xff00, Hi: 0xff60, Stride: 1},
+		{Lo: 0xffe0, Hi: 0xffe6, Stride: 1},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1f300, Hi: 0x1f64f, Stride: 1},
+		{Lo: 0x1f900, Hi: 0x1f9ff, Stride: 1},
+		{Lo: 0x20000, Hi: 0x2fffd, Stride: 1},
+		{Lo: 0x30000, Hi: 0x3fffd, Stride: 1},
+	},
+}
+
+// truncate cuts s down to at most width columns, replacing the tail with
+// an ellipsis when anything had to be dropped. A wide character that
+// doesn't fit whole is dropped too
+func truncate(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	if stringWidth(s) <= width {
+		return s
+	}
+
+	var builder strings.Builder
+	used := 0
+	for _, char := range s {
+		// leaving a column for the ellipsis
+		if used+runeWidth(char) > width-1 {
+			break
 		}
-		render++
+		used += runeWidth(char)
+		builder.WriteRune(char)
+	}
+	return builder.String() + Ellipsis
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// cut slices s around the first sep, like strings.Cut in newer Go
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
 	}
-	return render
+	return s, "", false
 }
+
 func move(x, y int) string {
 	return fmt.Sprintf("%s[%d;%dH", Escape, x, y)
 }
 
-func exec(cmd string) {
-	os.Stdout.WriteString(cmd)
+func (e *EditorConfig) exec(cmd string) {
+	io.WriteString(e.out, cmd)
 }
 
-func maybe(err error) {
+// maybe quits telling what went wrong when err is not nil
+func (e *EditorConfig) maybe(err error) {
 	if err == nil {
 		return
 	}
 
-	_ = fmt.Errorf("shutdown for error %s occurs", err)
+	e.restoreTerminal()
+	fmt.Fprintf(os.Stderr, "gim: %s\n", err)
+	os.Exit(1)
+}
 
-	exit(1)
+func (e *EditorConfig) exit(code int) {
+	e.restoreTerminal()
+	os.Exit(code)
 }
 
-func exit(code int) {
-	_, _ = os.Stdout.WriteString(CleanScreen + CursorReposition)
+// restoreTerminal leaves the terminal the way it was before gim started
+func (e *EditorConfig) restoreTerminal() {
+	_, _ = io.WriteString(e.out, CleanScreen+CursorReposition+CursorShow+MouseReportingOff+AlternateScreenOff)
 
-	DisableRawMode()
-	os.Exit(code)
+	e.DisableRawMode()
 }
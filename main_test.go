@@ -0,0 +1,834 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// newTestEditor is an editor of lines with the cursor at the start,
+// drawing to a buffer instead of the terminal
+func newTestEditor(lines ...string) *EditorConfig {
+	e := NewEditor(&bytes.Buffer{})
+	e.SetRows(0, 0, lines)
+	e.dirty = false
+	return e
+}
+
+func editorLines(e *EditorConfig) []string {
+	lines := []string{}
+	for _, row := range e.rows {
+		lines = append(lines, row.line)
+	}
+	return lines
+}
+
+func TestEditing(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		x, y  int
+		edit  func(e *EditorConfig)
+		want  []string
+		wantX int
+		wantY int
+	}{
+		{
+			name:  "insert char",
+			lines: []string{"ac"},
+			x:     1,
+			edit:  func(e *EditorConfig) { e.InsertChar('b') },
+			want:  []string{"abc"},
+			wantX: 2,
+		},
+		{
+			name:  "insert char into an empty buffer",
+			edit:  func(e *EditorConfig) { e.InsertChar('a') },
+			want:  []string{"a"},
+			wantX: 1,
+		},
+		{
+			name:  "insert multibyte char",
+			lines: []string{"ab"},
+			x:     1,
+			edit:  func(e *EditorConfig) { e.InsertChar('é') },
+			want:  []string{"aéb"},
+			wantX: 3,
+		},
+		{
+			name:  "insert string",
+			lines: []string{"ad"},
+			x:     1,
+			edit:  func(e *EditorConfig) { e.InsertString("bc") },
+			want:  []string{"abcd"},
+			wantX: 3,
+		},
+		{
+			name:  "split line",
+			lines: []string{"abcd"},
+			x:     2,
+			edit:  func(e *EditorConfig) { e.InsertNewLine() },
+			want:  []string{"ab", "cd"},
+			wantY: 1,
+		},
+		{
+			name:  "new line at the start",
+			lines: []string{"ab"},
+			edit:  func(e *EditorConfig) { e.InsertNewLine() },
+			want:  []string{"", "ab"},
+			wantY: 1,
+		},
+		{
+			name:  "new line in an empty buffer",
+			edit:  func(e *EditorConfig) { e.InsertNewLine() },
+			want:  []string{"", ""},
+			wantY: 1,
+		},
+		{
+			name:  "delete char",
+			lines: []string{"abc"},
+			x:     2,
+			edit:  func(e *EditorConfig) { e.DeleteChar() },
+			want:  []string{"ac"},
+			wantX: 1,
+		},
+		{
+			name:  "delete multibyte char",
+			lines: []string{"aéb"},
+			x:     3,
+			edit:  func(e *EditorConfig) { e.DeleteChar() },
+			want:  []string{"ab"},
+			wantX: 1,
+		},
+		{
+			name:  "delete at the start joins lines",
+			lines: []string{"ab", "cd"},
+			y:     1,
+			edit:  func(e *EditorConfig) { e.DeleteChar() },
+			want:  []string{"abcd"},
+			wantX: 2,
+		},
+		{
+			name:  "delete at the start of the buffer",
+			lines: []string{"ab"},
+			edit:  func(e *EditorConfig) { e.DeleteChar() },
+			want:  []string{"ab"},
+		},
+		{
+			name:  "insert row",
+			lines: []string{"a", "c"},
+			edit:  func(e *EditorConfig) { e.InsertRow(1, "b") },
+			want:  []string{"a", "b", "c"},
+		},
+		{
+			name:  "replace rows",
+			lines: []string{"a", "b", "c"},
+			edit:  func(e *EditorConfig) { e.ReplaceRows(0, 2, []string{"x"}) },
+			want:  []string{"x", "c"},
+		},
+		{
+			name:  "undo",
+			lines: []string{"ab"},
+			x:     1,
+			edit: func(e *EditorConfig) {
+				e.UndoBegin()
+				e.InsertChar('x')
+				e.InsertChar('y')
+				e.UndoEnd()
+				e.Undo()
+			},
+			want:  []string{"ab"},
+			wantX: 1,
+		},
+		{
+			name:  "read-only",
+			lines: []string{"ab"},
+			edit: func(e *EditorConfig) {
+				e.readOnly = true
+				e.InsertChar('x')
+			},
+			want: []string{"ab"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEditor(test.lines...)
+			e.x, e.y = test.x, test.y
+			test.edit(e)
+
+			if got := editorLines(e); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("lines = %q, want %q", got, test.want)
+			}
+			if e.x != test.wantX || e.y != test.wantY {
+				t.Errorf("cursor = %d,%d, want %d,%d", e.x, e.y, test.wantX, test.wantY)
+			}
+			if _, ok := e.GetCurRow(); !ok && len(e.rows) > 0 {
+				t.Errorf("cursor on row %d past the last one", e.y)
+			}
+			for i, row := range e.rows {
+				if row.idx != i {
+					t.Errorf("row %d has idx %d", i, row.idx)
+				}
+			}
+		})
+	}
+}
+
+func TestMoveCursor(t *testing.T) {
+	tests := []struct {
+		name  string
+		x, y  int
+		key   rune
+		wantX int
+		wantY int
+	}{
+		{"right", 0, 0, ArrowRight, 1, 0},
+		{"right over a multibyte char", 1, 1, ArrowRight, 3, 1},
+		{"right at the end of a line", 3, 0, ArrowRight, 0, 1},
+		{"left at the start of a line", 0, 1, ArrowLeft, 3, 0},
+		{"left at the start of the buffer", 0, 0, ArrowLeft, 0, 0},
+		{"up keeps within the shorter line", 4, 1, ArrowUp, 3, 0},
+		{"down at the last row", 1, 2, ArrowDown, 1, 2},
+		{"word right", 0, 2, CtrlArrowRight, 4, 2},
+		{"word left", 7, 2, CtrlArrowLeft, 4, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEditor("abc", "aéxy", "foo bar")
+			e.x, e.y = test.x, test.y
+			e.MoveCursor(test.key)
+			if e.x != test.wantX || e.y != test.wantY {
+				t.Errorf("cursor = %d,%d, want %d,%d", e.x, e.y, test.wantX, test.wantY)
+			}
+		})
+	}
+}
+
+func TestEditorsAreSeparate(t *testing.T) {
+	a, b := newTestEditor("a"), newTestEditor("b")
+	a.InsertChar('x')
+	if got := editorLines(b); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("other editor lines = %q", got)
+	}
+	if b.dirty {
+		t.Error("editing one editor made another dirty")
+	}
+
+	// each draws its own rows and search to its own writer
+	var outA, outB bytes.Buffer
+	a, b = newTestScreen(&outA, 6, 40, "apple"), newTestScreen(&outB, 6, 40, "banana")
+	a.FindCallBack("pp", 'p')
+	a.RefreshScreen()
+	b.RefreshScreen()
+	if !strings.Contains(outA.String(), "match 1 of 1") || strings.Contains(outA.String(), "banana") {
+		t.Errorf("first editor drew %q", outA.String())
+	}
+	if !strings.Contains(outB.String(), "banana") || strings.Contains(outB.String(), "apple") {
+		t.Errorf("second editor drew %q", outB.String())
+	}
+	if b.searchStatus != "" || b.lastMatch != -1 {
+		t.Errorf("searching one editor changed the search of another: %q", b.searchStatus)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s     string
+		width int
+		want  string
+	}{
+		{"Can't open ファイル/日本語.txt: no such file", 8, "Can't o…"},
+		{"日本語のメッセージ", 4, "日…"},
+		{"日本語", 6, "日本語"},
+		// a wide character is not split at the edge
+		{"a日本", 3, "a…"},
+		{"a日本", 4, "a日…"},
+		{"héllo", 5, "héllo"},
+		{"héllo", 1, "…"},
+		{"héllo", 0, ""},
+	}
+
+	for _, test := range tests {
+		got := truncate(test.s, test.width)
+		if got != test.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", test.s, test.width, got, test.want)
+		}
+		if !utf8.ValidString(got) || stringWidth(got) > test.width {
+			t.Errorf("truncate(%q, %d) = %q does not fit", test.s, test.width, got)
+		}
+	}
+}
+
+// newTestFile is an editor of lines highlighted as the file filename
+func newTestFile(filename string, lines ...string) *EditorConfig {
+	e := newTestEditor(lines...)
+	e.filename = filename
+	e.SelectSyntaxHighlight()
+	e.HighlightTo(len(e.rows) - 1)
+	return e
+}
+
+func TestDeleteRow(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		at    int
+		want  []string
+	}{
+		{"first", []string{"a", "b", "c"}, 0, []string{"b", "c"}},
+		{"last", []string{"a", "b", "c"}, 2, []string{"a", "b"}},
+		{"only", []string{"a"}, 0, []string{}},
+		{"past the end", []string{"a"}, 1, []string{"a"}},
+		{"before the start", []string{"a"}, -1, []string{"a"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEditor(test.lines...)
+			e.DeleteRow(test.at)
+			if got := editorLines(e); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("lines = %q, want %q", got, test.want)
+			}
+			for i, row := range e.rows {
+				if row.idx != i {
+					t.Errorf("row %d has idx %d", i, row.idx)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteRowHighlightsAgain(t *testing.T) {
+	e := newTestFile("test.c", "/* open", "int x;", "close */")
+	e.DeleteRow(0)
+	e.HighlightTo(len(e.rows) - 1)
+
+	for i, hl := range e.rows[0].highlight {
+		if hl == HighlightMultilineComment {
+			t.Fatalf("%q is still a comment at %d after the comment start was deleted", e.rows[0].line, i)
+		}
+	}
+	if e.rows[0].highlight[0] != HighLightKeyword2 {
+		t.Errorf("int is highlighted %d, want a type", e.rows[0].highlight[0])
+	}
+}
+
+func TestFindEmptyQuery(t *testing.T) {
+	e := newTestEditor("foo", "bar", "foo")
+	e.y = 1
+	e.searchStart = EditorPane{y: 1}
+
+	// toggling an option before typing anything
+	e.FindCallBack("", '\t')
+	if e.y != 1 || e.searchStatus != "ignore case" {
+		t.Errorf("empty query: cursor on row %d, status %q", e.y, e.searchStatus)
+	}
+
+	e.FindCallBack("f", 'f')
+	if e.y != 0 || e.searchStatus != "match 1 of 2 | ignore case" {
+		t.Errorf("query f: cursor on row %d, status %q", e.y, e.searchStatus)
+	}
+
+	e.FindCallBack("", Backspace)
+	if e.y != 1 || e.searchStatus != "ignore case" {
+		t.Errorf("query erased: cursor on row %d, status %q", e.y, e.searchStatus)
+	}
+	e.FindCallBack("", EscapeChar)
+}
+
+func TestSearchIndex(t *testing.T) {
+	tests := []struct {
+		line, query       string
+		x                 int
+		ignoreCase, regex bool
+		start, end        int
+	}{
+		{"foo Foo", "Foo", 0, false, false, 4, 7},
+		{"foo Foo", "Foo", 0, true, false, 0, 3},
+		{"foo Foo", "Foo", 1, true, false, 4, 7},
+		{"a fooo", "fo+", 0, false, true, 2, 6},
+		{"bab", "a*", 0, false, true, 1, 2},
+		{"bb", "a*", 0, false, true, -1, -1},
+		// the pattern sees the line before x
+		{"aaa", "^a", 0, false, true, 0, 1},
+		{"aaa", "^a", 1, false, true, -1, -1},
+		{"foo xfoo foo", `\bfoo`, 1, false, true, 9, 12},
+	}
+
+	for _, test := range tests {
+		e := newTestEditor()
+		e.searchIgnoreCase, e.searchRegexp = test.ignoreCase, test.regex
+		start, end := e.searchIndex(test.line, test.x, test.query)
+		if start != test.start || end != test.end {
+			t.Errorf("searchIndex(%q, %d, %q) = %d, %d, want %d, %d",
+				test.line, test.x, test.query, start, end, test.start, test.end)
+		}
+	}
+}
+
+func TestSearchCount(t *testing.T) {
+	e := newTestEditor()
+	e.searchRegexp = true
+	if got := e.searchCount("bab", "a*"); got != 1 {
+		t.Errorf("a* is found %d times in bab, want 1", got)
+	}
+	if got := e.searchCount("bab", ""); got != 0 {
+		t.Errorf("nothing is found %d times in bab, want 0", got)
+	}
+}
+
+func TestFindAfterTab(t *testing.T) {
+	e := newTestEditor("\tfoo foo")
+	e.FindCallBack("foo", 'o')
+	if e.x != 1 || e.searchStatus != "match 1 of 2" {
+		t.Errorf("cursor at %d, status %q", e.x, e.searchStatus)
+	}
+
+	// the match is highlighted where the tab leaves it on screen
+	want := []int{HighlightNormal, HighlightCurrentMatch, HighlightCurrentMatch, HighlightCurrentMatch,
+		HighlightNormal, HighlightMatch, HighlightMatch, HighlightMatch}
+	if got := e.rows[0].highlight[3:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("highlight of %q = %v, want %v", e.rows[0].render, got, want)
+	}
+
+	// a tab is found as itself, not as the spaces it is drawn with
+	e = newTestEditor("a\tb")
+	e.searchRegexp = true
+	e.FindCallBack(`\tb`, 'b')
+	want = []int{HighlightNormal, HighlightCurrentMatch, HighlightCurrentMatch, HighlightCurrentMatch, HighlightCurrentMatch}
+	if !e.searchFound || e.x != 1 || !reflect.DeepEqual(e.rows[0].highlight, want) {
+		t.Errorf("found %v at %d, highlight %v", e.searchFound, e.x, e.rows[0].highlight)
+	}
+}
+
+func TestFinderCrawlGeneration(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "b.go"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := newTestEditor()
+	e.finder.generation = 2
+	e.finderCrawl(dir, 1)
+	if len(e.finder.files) != 0 {
+		t.Errorf("a stale crawl added %q", e.finder.files)
+	}
+	e.finderCrawl(dir, 2)
+	if want := []string{"a.go", "b.go"}; !reflect.DeepEqual(e.finder.files, want) {
+		t.Errorf("files = %q, want %q", e.finder.files, want)
+	}
+}
+
+func TestLoadKeysFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		bindings string
+		wantErr  bool
+		want     map[string]rune
+	}{
+		{
+			name:     "rebind",
+			bindings: `{"Ctrl-W": "Save", "Ctrl-S": ""}`,
+			want:     map[string]rune{"Save": ctrlKey('w'), "Delete word": NoKey},
+		},
+		{
+			name:     "swap",
+			bindings: `{"Ctrl-W": "save", "Ctrl-S": "Delete word"}`,
+			want:     map[string]rune{"Save": ctrlKey('w'), "Delete word": ctrlKey('s')},
+		},
+		{name: "two keys for one command", bindings: `{"Ctrl-W": "Save", "Ctrl-X": "Save"}`, wantErr: true},
+		{name: "unknown command", bindings: `{"Ctrl-W": "Fly"}`, wantErr: true},
+		{name: "unknown key", bindings: `{"Hyper-W": "Save"}`, wantErr: true},
+	}
+
+	t.Cleanup(func() { actions = defaultActions() })
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "keys.json")
+			if err := os.WriteFile(filename, []byte(test.bindings), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			actions = defaultActions()
+			err := loadKeysFile(filename)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, want an error %v", err, test.wantErr)
+			}
+			for _, action := range actions {
+				if key, ok := test.want[action.name]; ok && action.key != key {
+					t.Errorf("%s is bound to %s, want %s", action.name, keyName(action.key), keyName(key))
+				}
+			}
+		})
+	}
+}
+
+func TestHighlightFlags(t *testing.T) {
+	const line = `x = "a1" + 42`
+	n, s, d := HighlightNormal, HighlightString, HighlightNumber
+	tests := []struct {
+		name  string
+		flags int
+		want  []int
+	}{
+		{"strings only", FlagHighlightString, []int{n, n, n, n, s, s, s, s, n, n, n, n, n}},
+		{"numbers only", FlagHighlightNumber, []int{n, n, n, n, n, n, n, n, n, n, n, d, d}},
+		{"both", FlagHighlightString | FlagHighlightNumber, []int{n, n, n, n, s, s, s, s, n, n, n, d, d}},
+		{"neither", 0, []int{n, n, n, n, n, n, n, n, n, n, n, n, n}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEditor(line)
+			e.syntax = &EditorSyntax{fileType: "test", flags: test.flags}
+			e.HighlightTo(0)
+			if got := e.rows[0].highlight; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("highlight = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// newTestScreen is an editor of lines drawing a window of rows and cols to out
+func newTestScreen(out *bytes.Buffer, rows, cols int, lines ...string) *EditorConfig {
+	e := NewEditor(out)
+	e.SetRows(0, 0, lines)
+	e.dirty = false
+	e.screenRows, e.screenCols = rows-2, cols
+	return e
+}
+
+func TestRefreshScreen(t *testing.T) {
+	var out bytes.Buffer
+	e := newTestScreen(&out, 6, 40, "hello", "world")
+	e.RefreshScreen()
+
+	got := out.String()
+	if !strings.HasPrefix(got, CursorHide) || !strings.HasSuffix(got, CursorShow) {
+		t.Errorf("the cursor is not hidden while drawing: %q", got)
+	}
+	for i, want := range []string{"hello", "world", "~"} {
+		// each line drawn at its start, on a clean line
+		start := strings.Index(got, move(i+1, 1))
+		end := strings.Index(got, move(i+2, 1))
+		if start == -1 || end < start {
+			t.Fatalf("screen line %d is not drawn at its start: %q", i+1, got)
+		}
+		line := got[start:end]
+		if !strings.Contains(line, CleanLine) || !strings.HasSuffix(line, want) {
+			t.Errorf("screen line %d is %q, want %q on a clean line", i+1, line, want)
+		}
+	}
+	if want := move(1, 1) + CursorShow; !strings.HasSuffix(got, want) {
+		t.Errorf("the cursor is not moved back to the top left: %q", got)
+	}
+
+	// nothing changed, only the cursor is drawn again
+	out.Reset()
+	e.RefreshScreen()
+	got = out.String()
+	if strings.Contains(got, CleanLine) || !strings.HasSuffix(got, move(1, 1)+CursorShow) {
+		t.Errorf("refresh without changes = %q", got)
+	}
+}
+
+func TestRefreshScreenTooSmall(t *testing.T) {
+	for _, size := range [][2]int{{1, 1}, {1, 80}, {24, 1}, {MinWindowRows - 1, MinWindowCols}} {
+		var out bytes.Buffer
+		e := newTestScreen(&out, size[0], size[1], "hello", "world")
+		e.RefreshScreen()
+
+		got := out.String()
+		if strings.Contains(got, "hello") || !strings.Contains(got, CursorHide) {
+			t.Errorf("%dx%d: drew the text instead of the notice: %q", size[1], size[0], got)
+		}
+		if strings.Count(got, NewLine) > size[0]-1 {
+			t.Errorf("%dx%d: drew more lines than fit: %q", size[1], size[0], got)
+		}
+	}
+}
+
+func BenchmarkScroll(b *testing.B) {
+	lines := []string{}
+	for i := 0; i < 10000; i++ {
+		lines = append(lines, fmt.Sprintf("\tx%d := fmt.Sprintf(\"row %%d\", %d) // scrolled past", i, i))
+	}
+
+	for _, cache := range []bool{false, true} {
+		b.Run(fmt.Sprintf("draw-cache=%v", cache), func(b *testing.B) {
+			var out bytes.Buffer
+			e := newTestScreen(&out, 50, 120, lines...)
+			e.filename = "scroll.go"
+			e.SelectSyntaxHighlight()
+			e.HighlightTo(len(e.rows) - 1)
+			e.theme, e.colorMode = &DefaultTheme, ColorMode256
+			e.drawCache = cache
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// one row down, so most rows on screen were drawn in the last frame
+				e.ScrollBy(1)
+				if e.offRow == len(e.rows)-1 {
+					e.offRow, e.y = 0, 0
+				}
+				e.RefreshScreen()
+				out.Reset()
+			}
+		})
+	}
+}
+
+func TestInsertTab(t *testing.T) {
+	tests := []struct {
+		mode  string
+		width int
+		line  string
+		x     int
+		want  string
+		wantX int
+	}{
+		{TabModeLiteral, 4, "ab", 0, "\tab", 1},
+		{TabModeLiteral, 4, "ab", 1, "a\tb", 2},
+		{TabModeSpaces, 4, "ab", 0, "    ab", 4},
+		{TabModeSpaces, 4, "ab", 1, "a    b", 5},
+		{TabModeSpaces, 2, "ab", 2, "ab  ", 4},
+		{TabModeStop, 4, "", 0, "    ", 4},
+		{TabModeStop, 4, "ab", 1, "a   b", 4},
+		{TabModeStop, 4, "abc", 3, "abc ", 4},
+		{TabModeStop, 4, "abcd", 4, "abcd    ", 8},
+		{TabModeStop, 8, "ab", 2, "ab      ", 8},
+		// the tab before the cursor counts as the columns it takes on screen
+		{TabModeStop, 4, "\tx", 2, "\tx   ", 5},
+	}
+
+	for _, test := range tests {
+		e := newTestEditor(test.line)
+		e.tabMode, e.tabWidth = test.mode, test.width
+		e.x = test.x
+		e.InsertTab()
+		if got := e.rows[0].line; got != test.want || e.x != test.wantX {
+			t.Errorf("%s width %d, %q at %d: got %q at %d, want %q at %d",
+				test.mode, test.width, test.line, test.x, got, e.x, test.want, test.wantX)
+		}
+	}
+}
+
+func TestIndentProfile(t *testing.T) {
+	// yaml is not built in, it comes from a syntax file
+	saved := HighlightDatabase
+	HighlightDatabase = append(HighlightDatabase[:len(saved):len(saved)],
+		EditorSyntax{fileType: "yaml", fileMatch: []string{".yaml", ".yml"}})
+	t.Cleanup(func() { HighlightDatabase = saved })
+
+	tests := []struct {
+		filename string
+		want     IndentProfile
+	}{
+		{"main.go", IndentProfile{tabMode: TabModeLiteral, tabWidth: 4}},
+		{"main.py", IndentProfile{tabMode: TabModeSpaces, tabWidth: 4}},
+		{"config.yaml", IndentProfile{tabMode: TabModeSpaces, tabWidth: 2}},
+		{"notes.txt", IndentProfile{tabMode: TabModeSpaces, tabWidth: 3}},
+	}
+
+	for _, test := range tests {
+		e := newTestEditor("x")
+		e.defaultIndent = IndentProfile{tabMode: TabModeSpaces, tabWidth: 3}
+		e.filename = test.filename
+		e.SelectSyntaxHighlight()
+		if got := (IndentProfile{tabMode: e.tabMode, tabWidth: e.tabWidth}); got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.filename, got, test.want)
+		}
+	}
+}
+
+func TestDetectIndent(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  *IndentProfile
+	}{
+		{"tabs", []string{"func f() {", "\tif x {", "\t\treturn", "\t}", "}"},
+			&IndentProfile{tabMode: TabModeLiteral}},
+		{"2 spaces", []string{"a:", "  b:", "    c: 1", "  d: 2"},
+			&IndentProfile{tabMode: TabModeSpaces, tabWidth: 2}},
+		{"4 spaces", []string{"def f():", "    if x:", "        return 1", "", "    return 2"},
+			&IndentProfile{tabMode: TabModeSpaces, tabWidth: 4}},
+		{"mostly tabs", []string{"a", "\tb", "\tc", "    d"},
+			&IndentProfile{tabMode: TabModeLiteral}},
+		{"mostly spaces", []string{"a", "    b", "    c", "\td"},
+			&IndentProfile{tabMode: TabModeSpaces, tabWidth: 4}},
+		{"as many tabs as spaces", []string{"a", "\tb", "  c"}, nil},
+		{"no indentation", []string{"a", "b"}, nil},
+		{"empty", nil, nil},
+	}
+
+	for _, test := range tests {
+		got := detectIndent(newTestEditor(test.lines...).rows)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestStatusBarLine(t *testing.T) {
+	const width = 20
+	tests := []struct {
+		left, right string
+		want        string
+	}{
+		{"[+] ドキュメント/とても長い日本語のファイル名.txt - 12 lines", "go | 3/12",
+			"[+] ドキ…  go | 3/12"},
+		{"a.txt", "1/1", "a.txt            1/1"},
+		{"a.txt", "ドキュメント/とても長い日本語のファイル名です", "ドキュメント/とても…"},
+		{"ドキュメント/とても長い日本語のファイル名です", "", "ドキュメント/とても…"},
+	}
+
+	for _, test := range tests {
+		got := statusBarLine(test.left, test.right, width)
+		if got != test.want {
+			t.Errorf("statusBarLine(%q, %q) = %q, want %q", test.left, test.right, got, test.want)
+		}
+		if !utf8.ValidString(got) || stringWidth(got) != width {
+			t.Errorf("statusBarLine(%q, %q) = %q is %d columns, want %d",
+				test.left, test.right, got, stringWidth(got), width)
+		}
+	}
+}
+
+func TestDrawControlCharacter(t *testing.T) {
+	var out bytes.Buffer
+	e := newTestScreen(&out, 10, 80, "x := \"a\x01b\"", "ab\x01cd")
+	e.theme, e.colorMode = &DefaultTheme, ColorMode256
+	e.filename = "control.go"
+	e.SelectSyntaxHighlight()
+	e.HighlightTo(len(e.rows) - 1)
+
+	// the symbol is inverted, and the rest of the string has the string color again
+	str := e.SyntaxToColor(HighlightString)
+	got := e.DrawRow(&e.rows[0], 0)
+	if want := str + "\"a" + ColorInverted + "A" + ColorBack + str + "b\""; !strings.Contains(got, want) {
+		t.Errorf("control byte in a string: got %q, want it to contain %q", got, want)
+	}
+
+	// within the current match the rest of the match is inverted again
+	row := &e.rows[1]
+	for i := 1; i <= 3; i++ {
+		row.highlight[i] = HighlightCurrentMatch
+	}
+	match := e.SyntaxToColor(HighlightCurrentMatch)
+	got = e.DrawRow(row, 0)
+	want := "a" + ColorInverted + match + "b" + ColorInverted + "A" + ColorBack + ColorInverted + match + "c" + ColorBack + "d"
+	if !strings.Contains(got, want) {
+		t.Errorf("control byte in a search match: got %q, want it to contain %q", got, want)
+	}
+}
+
+func TestNarrowHighlight(t *testing.T) {
+	e := newTestFile("narrow.c", "/* open", "still", "closed */ x", "int y;")
+	if !e.NarrowTo(2, 3) {
+		t.Fatal("can't narrow to lines 2-3")
+	}
+
+	// the first row keeps the comment opened before it
+	e.InsertChar('s')
+	e.HighlightTo(len(e.rows) - 1)
+	if got := e.rows[0].highlight[0]; got != HighlightMultilineComment {
+		t.Errorf("first narrowed row highlighted %d, want a comment", got)
+	}
+
+	// the comment no longer ends in the region, so the rows after it are in it too
+	e.SetLine(1, "still open")
+	e.Widen()
+	e.HighlightTo(len(e.rows) - 1)
+	if got := e.rows[3].highlight[0]; got != HighlightMultilineComment {
+		t.Errorf("row after the region highlighted %d, want a comment", got)
+	}
+}
+
+func TestSetRows(t *testing.T) {
+	tests := []struct {
+		name  string
+		at, n int
+		lines []string
+		want  []string
+	}{
+		{"same count", 1, 1, []string{"B"}, []string{"a", "B", "c", "d"}},
+		{"more", 1, 1, []string{"B", "B2", "B3"}, []string{"a", "B", "B2", "B3", "c", "d"}},
+		{"fewer", 1, 2, []string{"BC"}, []string{"a", "BC", "d"}},
+		{"none", 0, 4, nil, []string{}},
+		{"insert", 4, 0, []string{"e"}, []string{"a", "b", "c", "d", "e"}},
+		{"past the end", 3, 5, []string{"D"}, []string{"a", "b", "c", "D"}},
+	}
+
+	for _, test := range tests {
+		e := newTestEditor("a", "b", "c", "d")
+		e.SetRows(test.at, test.n, test.lines)
+		if got := editorLines(e); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: lines = %q, want %q", test.name, got, test.want)
+		}
+		for i, row := range e.rows {
+			if row.idx != i {
+				t.Errorf("%s: row %d has index %d", test.name, i, row.idx)
+			}
+		}
+	}
+
+	// a line changed in place leaves the other rows where they are
+	e := newTestEditor("a", "b", "c")
+	first := &e.rows[0]
+	e.ReplaceRows(1, 2, []string{"B"})
+	if &e.rows[0] != first {
+		t.Error("replacing a line copied the rows")
+	}
+}
+
+func TestFollow(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "follow.log")
+	write := func(text string) {
+		file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if _, err := file.WriteString(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("a\nb\n")
+	e := newTestEditor()
+	e.maxLoadLines = 4
+	if err := e.Open(filename); err != nil {
+		t.Fatal(err)
+	}
+	e.StartFollow()
+
+	// narrowed, the lines wait for the whole buffer
+	e.NarrowTo(1, 1)
+	write("c\nd")
+	if e.Follow() || len(e.rows) != 1 {
+		t.Errorf("narrowed buffer followed to %q", editorLines(e))
+	}
+	e.Widen()
+	if !e.Follow() || !reflect.DeepEqual(editorLines(e), []string{"a", "b", "c"}) {
+		t.Errorf("lines after widening = %q", editorLines(e))
+	}
+
+	// no further than the line limit
+	write("\ne\nf\n")
+	e.Follow()
+	if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(editorLines(e), want) || !e.partial {
+		t.Errorf("lines = %q partial %v, want %q partial", editorLines(e), e.partial, want)
+	}
+	write("g\n")
+	if e.Follow() || len(e.rows) != 4 {
+		t.Errorf("partial buffer followed to %q", editorLines(e))
+	}
+}
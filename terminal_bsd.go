@@ -0,0 +1,20 @@
+//go:build darwin || freebsd || netbsd || openbsd || dragonfly
+// +build darwin freebsd netbsd openbsd dragonfly
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// getTermios reads the terminal attributes of fd
+func getTermios(fd int, termios *syscall.Termios) syscall.Errno {
+	return ioctl(fd, syscall.TIOCGETA, unsafe.Pointer(termios))
+}
+
+// setTermios sets the terminal attributes of fd, once pending output is written
+// and discarding pending input
+func setTermios(fd int, termios *syscall.Termios) syscall.Errno {
+	return ioctl(fd, syscall.TIOCSETAF, unsafe.Pointer(termios))
+}
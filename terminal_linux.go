@@ -0,0 +1,21 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// tcsetsf is TCSETSF, which the syscall package doesn't have. It is TCSETS
+// plus two on every architecture, 0x5404 on x86 and arm
+const tcsetsf = syscall.TCSETS + 2
+
+// getTermios reads the terminal attributes of fd
+func getTermios(fd int, termios *syscall.Termios) syscall.Errno {
+	return ioctl(fd, syscall.TCGETS, unsafe.Pointer(termios))
+}
+
+// setTermios sets the terminal attributes of fd, once pending output is written
+// and discarding pending input
+func setTermios(fd int, termios *syscall.Termios) syscall.Errno {
+	return ioctl(fd, tcsetsf, unsafe.Pointer(termios))
+}